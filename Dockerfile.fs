@@ -1,4 +1,4 @@
-FROM golang:1.15-buster AS build
+FROM golang:1.16-buster AS build
 
 RUN apt-get update && apt-get install -y --no-install-recommends bash curl git
 RUN curl https://raw.githubusercontent.com/golang/dep/master/install.sh | sh
@@ -11,8 +11,9 @@ ADD cmd ./cmd
 ADD pkg ./pkg
 
 RUN dep ensure
-RUN CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o lodestone-fs-publisher ./cmd/fs-publisher/fs-publisher.go
+RUN CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o lodestone-publisher ./cmd/lodestone-publisher
 
 FROM scratch
-COPY --from=build /go/src/github.com/analogj/lodestone-publisher/lodestone-fs-publisher /lodestone-fs-publisher
-CMD ["/lodestone-fs-publisher"]
+COPY --from=build /go/src/github.com/analogj/lodestone-publisher/lodestone-publisher /lodestone-publisher
+ENTRYPOINT ["/lodestone-publisher"]
+CMD ["fs", "--help"]
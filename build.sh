@@ -4,8 +4,6 @@ dep ensure
 
 # go test -v ./...
 
-go build -o lodestone-fs-publisher-linux-amd64 ./cmd/fs-publisher/fs-publisher.go
-go build -o lodestone-email-publisher-linux-amd64 ./cmd/email-publisher/email-publisher.go
+go build -o lodestone-publisher-linux-amd64 ./cmd/lodestone-publisher
 
-./lodestone-fs-publisher-linux-amd64 --help
-./lodestone-email-publisher-linux-amd64 --help
+./lodestone-publisher-linux-amd64 --help
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/config"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"github.com/urfave/cli"
+	"strconv"
+	"strings"
+)
+
+var emailCommand = cli.Command{
+	Name:  "email",
+	Usage: "Start the Lodestone email watcher",
+	Description: "Watches one or more folders of one imap account. Every folder uses the same settings, only the bucket\n" +
+		"   can be set per folder (--imap-folder FOLDER=BUCKET). Use \"run --config\" to watch several accounts, or to\n" +
+		"   change other settings (eg. --post-process or --key-template) per folder.",
+	Action: func(c *cli.Context) error {
+		load := func() (*config.File, error) {
+			sources, err := emailFolderSources(c.StringSlice("imap-folder"), func() map[string]string { return emailSourceConfig(c) })
+			if err != nil {
+				return nil, err
+			}
+			return &config.File{Sources: sources}, nil
+		}
+		return runSources(c, load, "", 0)
+	},
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:   "imap-hostname",
+			Usage:  "The imap server hostname",
+			EnvVar: "LODESTONE_IMAP_HOSTNAME",
+		},
+		&cli.StringFlag{
+			Name:   "imap-port",
+			Usage:  "The imap server port",
+			Value:  "993",
+			EnvVar: "LODESTONE_IMAP_PORT",
+		},
+		&cli.StringFlag{
+			Name:   "imap-username",
+			Usage:  "The imap server username",
+			EnvVar: "LODESTONE_IMAP_USERNAME",
+		},
+		&cli.StringFlag{
+			Name:   "imap-password",
+			Usage:  "The imap server password",
+			EnvVar: "LODESTONE_IMAP_PASSWORD",
+		},
+		&cli.StringFlag{
+			Name:   "imap-password-file",
+			Usage:  "A file containing the imap server password (eg. a docker secret), instead of --imap-password",
+			EnvVar: "LODESTONE_IMAP_PASSWORD_FILE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "imap-folder",
+			Usage:  "The folder to watch, as FOLDER or FOLDER=BUCKET to publish to another bucket than --bucket (may be repeated, every folder uses the other settings). Defaults to INBOX.",
+			EnvVar: "LODESTONE_IMAP_FOLDER",
+		},
+		&cli.StringFlag{
+			Name:   "imap-interval",
+			Usage:  "The number of seconds to wait before checking for new messages (when idling, the maximum wait)",
+			Value:  "600", //10 minutes
+			EnvVar: "LODESTONE_IMAP_INTERVAL",
+		},
+		&cli.BoolTFlag{
+			Name:   "imap-idle",
+			Usage:  "Wait for new messages with IMAP IDLE, if the server supports it (--imap-idle=false to always poll)",
+			EnvVar: "LODESTONE_IMAP_IDLE",
+		},
+		&cli.StringFlag{
+			Name:   "post-process",
+			Usage:  "What to do with processed messages: delete, move (to --processed-folder) or flag (with --processed-flag)",
+			Value:  "delete",
+			EnvVar: "LODESTONE_POST_PROCESS",
+		},
+		&cli.StringFlag{
+			Name:   "processed-folder",
+			Usage:  "The folder processed messages are moved to, with --post-process move",
+			Value:  "Processed",
+			EnvVar: "LODESTONE_PROCESSED_FOLDER",
+		},
+		&cli.StringFlag{
+			Name:   "processed-flag",
+			Usage:  "The keyword (or flag, eg. \\Seen) added to processed messages, with --post-process flag",
+			Value:  "$LodestoneProcessed",
+			EnvVar: "LODESTONE_PROCESSED_FLAG",
+		},
+		&cli.StringFlag{
+			Name:   "on-failure",
+			Usage:  "What to do with messages that could not be processed: move (to --failed-folder) or keep (retried by the next check)",
+			Value:  "move",
+			EnvVar: "LODESTONE_ON_FAILURE",
+		},
+		&cli.StringFlag{
+			Name:   "failed-folder",
+			Usage:  "The folder messages that could not be processed are moved to, with --on-failure move",
+			Value:  "Failed",
+			EnvVar: "LODESTONE_FAILED_FOLDER",
+		},
+		&cli.StringSliceFlag{
+			Name:   "allow-senders",
+			Usage:  "Only accept messages from this sender address or domain (may be repeated). Defaults to all senders.",
+			EnvVar: "LODESTONE_ALLOW_SENDERS",
+		},
+		&cli.StringSliceFlag{
+			Name:   "deny-senders",
+			Usage:  "Reject messages from this sender address or domain (may be repeated)",
+			EnvVar: "LODESTONE_DENY_SENDERS",
+		},
+		&cli.BoolFlag{
+			Name:   "require-spf",
+			Usage:  "Reject messages without an SPF pass in the Authentication-Results header",
+			EnvVar: "LODESTONE_REQUIRE_SPF",
+		},
+		&cli.BoolFlag{
+			Name:   "require-dkim",
+			Usage:  "Reject messages without a valid DKIM signature from the sender domain",
+			EnvVar: "LODESTONE_REQUIRE_DKIM",
+		},
+		&cli.StringFlag{
+			Name:   "authserv-id",
+			Usage:  "Only trust Authentication-Results headers added by this server (authserv-id). Defaults to the topmost header.",
+			EnvVar: "LODESTONE_AUTHSERV_ID",
+		},
+		&cli.StringSliceFlag{
+			Name:   "attachment-types",
+			Usage:  "Only store attachments of this content type, detected from the content, eg. application/pdf or image/* (may be repeated, * for any). Defaults to documents and images.",
+			EnvVar: "LODESTONE_ATTACHMENT_TYPES",
+		},
+		&cli.StringSliceFlag{
+			Name:   "attachment-extensions",
+			Usage:  "Only store attachments with this file extension, eg. pdf (may be repeated, * for any). Defaults to documents and images.",
+			EnvVar: "LODESTONE_ATTACHMENT_EXTENSIONS",
+		},
+		&cli.StringSliceFlag{
+			Name:   "attachment-include",
+			Usage:  "Only store attachments with a filename matching this glob, eg. invoice-*.pdf (may be repeated)",
+			EnvVar: "LODESTONE_ATTACHMENT_INCLUDE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "attachment-exclude",
+			Usage:  "Skip attachments with a filename matching this glob, eg. image0*.png (may be repeated)",
+			EnvVar: "LODESTONE_ATTACHMENT_EXCLUDE",
+		},
+		&cli.StringFlag{
+			Name:   "attachment-min-size",
+			Usage:  "Skip attachments smaller than this number of bytes (eg. signature logos)",
+			Value:  "10240", //10 KiB
+			EnvVar: "LODESTONE_ATTACHMENT_MIN_SIZE",
+		},
+		&cli.StringFlag{
+			Name:   "attachment-max-size",
+			Usage:  "Skip attachments larger than this number of bytes (0 for no limit)",
+			Value:  "26214400", //25 MiB
+			EnvVar: "LODESTONE_ATTACHMENT_MAX_SIZE",
+		},
+		&cli.StringFlag{
+			Name:   "key-template",
+			Usage:  "The storage key of attachments, with {date}, {year}, {month}, {day}, {sender}, {sender-domain}, {message-hash}, {uid}, {mailbox}, {index} and {filename} placeholders",
+			Value:  "email/{date}/{message-hash}/{filename}",
+			EnvVar: "LODESTONE_KEY_TEMPLATE",
+		},
+		&cli.StringFlag{
+			Name:   "key-collision",
+			Usage:  "What to do when the key is already used: skip-identical (skip the upload if the ETag matches, otherwise add a suffix), suffix (add -1, -2, ...), hash (add the content hash) or overwrite",
+			Value:  "skip-identical",
+			EnvVar: "LODESTONE_KEY_COLLISION",
+		},
+		&cli.BoolFlag{
+			Name:   "store-eml",
+			Usage:  "Also store the original message, as message.eml",
+			EnvVar: "LODESTONE_STORE_EML",
+		},
+		&cli.StringFlag{
+			Name:   "store-body",
+			Usage:  "Also store the message body: none, text (as body.txt), html (as body.html) or both",
+			Value:  "none",
+			EnvVar: "LODESTONE_STORE_BODY",
+		},
+		&cli.BoolFlag{
+			Name:   "store-metadata",
+			Usage:  "Also store the message headers, and the keys of the stored objects, as metadata.json",
+			EnvVar: "LODESTONE_STORE_METADATA",
+		},
+
+		&cli.StringFlag{
+			Name:   "api-endpoint",
+			Usage:  "The api server endpoint",
+			Value:  "http://webapp:3000",
+			EnvVar: "LODESTONE_API_ENDPOINT",
+		},
+		&cli.StringFlag{
+			Name:   "bucket",
+			Usage:  "The name of the bucket",
+			EnvVar: "LODESTONE_BUCKET",
+		},
+	},
+}
+
+// emailFolderSources returns one source (and imap connection) per --imap-folder value, FOLDER or FOLDER=BUCKET. Only
+// the folder and bucket vary, the other settings are the same for every folder (see emailSourceConfig).
+func emailFolderSources(folders []string, sourceConfig func() map[string]string) ([]watch.SourceConfig, error) {
+	if len(folders) == 0 {
+		folders = []string{"INBOX"}
+	}
+	sources := []watch.SourceConfig{}
+	names := map[string]bool{}
+	for _, value := range folders {
+		config := sourceConfig()
+		folder := value
+		if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+			folder = parts[0]
+			if parts[1] == "" {
+				return nil, fmt.Errorf("invalid --imap-folder %q: the bucket is empty, use FOLDER or FOLDER=BUCKET", value)
+			}
+			config["bucket"] = parts[1]
+		}
+		if folder == "" {
+			return nil, fmt.Errorf("invalid --imap-folder %q: the folder is empty, use FOLDER or FOLDER=BUCKET", value)
+		}
+		config["imap-folder"] = folder
+
+		name := "email:" + config["imap-username"]
+		if folder != "INBOX" {
+			name += "/" + folder
+		}
+		if names[name] {
+			return nil, fmt.Errorf("invalid --imap-folder %q: the folder is already watched", value)
+		}
+		names[name] = true
+		sources = append(sources, watch.SourceConfig{Name: name, Source: "email", Config: config})
+	}
+	return sources, nil
+}
+
+// emailSourceConfig converts the flags into an "email" source config
+func emailSourceConfig(c *cli.Context) map[string]string {
+	return map[string]string{
+		"imap-hostname":         c.String("imap-hostname"),
+		"imap-port":             c.String("imap-port"),
+		"imap-username":         c.String("imap-username"),
+		"imap-password":         c.String("imap-password"),
+		"imap-password-file":    c.String("imap-password-file"),
+		"imap-interval":         c.String("imap-interval"),
+		"imap-idle":             strconv.FormatBool(c.BoolT("imap-idle")),
+		"post-process":          c.String("post-process"),
+		"processed-folder":      c.String("processed-folder"),
+		"processed-flag":        c.String("processed-flag"),
+		"on-failure":            c.String("on-failure"),
+		"failed-folder":         c.String("failed-folder"),
+		"allow-senders":         strings.Join(c.StringSlice("allow-senders"), ","),
+		"deny-senders":          strings.Join(c.StringSlice("deny-senders"), ","),
+		"require-spf":           strconv.FormatBool(c.Bool("require-spf")),
+		"require-dkim":          strconv.FormatBool(c.Bool("require-dkim")),
+		"authserv-id":           c.String("authserv-id"),
+		"attachment-types":      strings.Join(c.StringSlice("attachment-types"), ","),
+		"attachment-extensions": strings.Join(c.StringSlice("attachment-extensions"), ","),
+		"attachment-include":    strings.Join(c.StringSlice("attachment-include"), ","),
+		"attachment-exclude":    strings.Join(c.StringSlice("attachment-exclude"), ","),
+		"attachment-min-size":   c.String("attachment-min-size"),
+		"attachment-max-size":   c.String("attachment-max-size"),
+		"key-template":          c.String("key-template"),
+		"key-collision":         c.String("key-collision"),
+		"store-eml":             strconv.FormatBool(c.Bool("store-eml")),
+		"store-body":            c.String("store-body"),
+		"store-metadata":        strconv.FormatBool(c.Bool("store-metadata")),
+		"bucket":                c.String("bucket"),
+		"api-endpoint":          c.String("api-endpoint"),
+	}
+}
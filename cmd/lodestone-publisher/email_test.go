@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEmailFolderSources(t *testing.T) {
+	sourceConfig := func() map[string]string {
+		return map[string]string{"imap-username": "docs@example.com", "bucket": "documents", "post-process": "move"}
+	}
+	tests := []struct {
+		name    string
+		folders []string
+		want    map[string]map[string]string
+		wantErr string
+	}{
+		{
+			name: "default folder",
+			want: map[string]map[string]string{
+				"email:docs@example.com": {"imap-folder": "INBOX", "bucket": "documents"},
+			},
+		},
+		{
+			name:    "bucket per folder",
+			folders: []string{"INBOX", "Receipts=finance", "Medical/2021=medical"},
+			want: map[string]map[string]string{
+				"email:docs@example.com":              {"imap-folder": "INBOX", "bucket": "documents"},
+				"email:docs@example.com/Receipts":     {"imap-folder": "Receipts", "bucket": "finance"},
+				"email:docs@example.com/Medical/2021": {"imap-folder": "Medical/2021", "bucket": "medical"},
+			},
+		},
+		{
+			// only the first = separates the bucket
+			name:    "bucket with =",
+			folders: []string{"Receipts=a=b"},
+			want: map[string]map[string]string{
+				"email:docs@example.com/Receipts": {"imap-folder": "Receipts", "bucket": "a=b"},
+			},
+		},
+		{name: "empty bucket", folders: []string{"INBOX", "Receipts="}, wantErr: `invalid --imap-folder "Receipts=": the bucket is empty, use FOLDER or FOLDER=BUCKET`},
+		{name: "empty folder", folders: []string{"=finance"}, wantErr: `invalid --imap-folder "=finance": the folder is empty, use FOLDER or FOLDER=BUCKET`},
+		{name: "duplicate folder", folders: []string{"Receipts", "Receipts=finance"}, wantErr: `invalid --imap-folder "Receipts=finance": the folder is already watched`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sources, err := emailFolderSources(test.folders, sourceConfig)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("emailFolderSources() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]map[string]string{}
+			for _, source := range sources {
+				if source.Source != "email" {
+					t.Errorf("%v: source = %q, want email", source.Name, source.Source)
+				}
+				// the other settings are the same for every folder
+				if source.Config["imap-username"] != "docs@example.com" || source.Config["post-process"] != "move" {
+					t.Errorf("%v: config = %v, want the shared settings", source.Name, source.Config)
+				}
+				got[source.Name] = map[string]string{"imap-folder": source.Config["imap-folder"], "bucket": source.Config["bucket"]}
+			}
+			if len(sources) != len(test.want) || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sources = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
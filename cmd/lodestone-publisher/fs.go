@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/config"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"github.com/urfave/cli"
+	"strconv"
+	"strings"
+)
+
+var fsCommand = cli.Command{
+	Name:  "fs",
+	Usage: "Start the Lodestone filesystem watcher",
+	Action: func(c *cli.Context) error {
+		// the sources are rebuilt from the flags on every (re)load
+		load := func() (*config.File, error) {
+			// settings shared by every root, unless overridden in the --root spec
+			defaults := map[string]string{
+				"prefix":  c.String("prefix"),
+				"source":  c.String("source"),
+				"include": strings.Join(c.StringSlice("include"), ","),
+				"exclude": strings.Join(c.StringSlice("exclude"), ","),
+
+				"watch-mode":    c.String("watch-mode"),
+				"poll-interval": c.String("poll-interval"),
+
+				"workers":    c.String("workers"),
+				"queue-size": c.String("queue-size"),
+
+				"mirror":       strconv.FormatBool(c.Bool("mirror")),
+				"api-endpoint": c.String("api-endpoint"),
+
+				"state-dir":        c.String("state-dir"),
+				"shutdown-timeout": c.GlobalString("shutdown-timeout"),
+			}
+
+			sources := []watch.SourceConfig{}
+			if c.String("dir") != "" {
+				// single directory flags
+				root, err := parseRootSpec("", defaults, map[string]string{"dir": c.String("dir"), "bucket": c.String("bucket")})
+				if err != nil {
+					return nil, err
+				}
+				sources = append(sources, watch.SourceConfig{Name: "fs:" + root["dir"], Source: "fs", Config: root})
+			}
+			for _, rootSpec := range c.StringSlice("root") {
+				root, err := parseRootSpec(rootSpec, defaults, nil)
+				if err != nil {
+					return nil, err
+				}
+				sources = append(sources, watch.SourceConfig{Name: "fs:" + root["dir"], Source: "fs", Config: root})
+			}
+			if len(sources) == 0 {
+				return nil, errors.New("no directories to watch, --dir or --root is required")
+			}
+
+			return &config.File{Sources: sources}, nil
+		}
+		return runSources(c, load, "", 0)
+	},
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:   "dir",
+			Usage:  "The directory to watch for file changes.",
+			EnvVar: "LODESTONE_DIR",
+		},
+		&cli.StringFlag{
+			Name:   "bucket",
+			Usage:  "The name of the bucket",
+			EnvVar: "LODESTONE_BUCKET",
+		},
+		&cli.StringSliceFlag{
+			Name:   "root",
+			Usage:  "An additional directory to watch (may be repeated), eg. 'dir=/data/scans;bucket=documents;prefix=scans;source=scanner;include=*.pdf,*.tif;exclude=tmp/'",
+			EnvVar: "LODESTONE_ROOT",
+		},
+		&cli.StringFlag{
+			Name:   "prefix",
+			Usage:  "The key prefix for objects published from the watched directories",
+			EnvVar: "LODESTONE_PREFIX",
+		},
+		&cli.StringFlag{
+			Name:   "source",
+			Usage:  "The event source name (lodestone:publisher:<source>)",
+			Value:  "fs",
+			EnvVar: "LODESTONE_SOURCE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "include",
+			Usage:  "Only publish files matching this glob (may be repeated). Defaults to all files.",
+			EnvVar: "LODESTONE_INCLUDE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "exclude",
+			Usage:  "Skip files & directories matching this gitignore-style glob (may be repeated). Patterns can also be placed in .lodestoneignore files",
+			EnvVar: "LODESTONE_EXCLUDE",
+		},
+		&cli.StringFlag{
+			Name:   "watch-mode",
+			Usage:  "How to detect file changes: inotify, poll, or auto (poll when the directory is on a NFS/SMB/FUSE mount)",
+			Value:  "auto",
+			EnvVar: "LODESTONE_WATCH_MODE",
+		},
+		&cli.StringFlag{
+			Name:   "poll-interval",
+			Usage:  "The number of seconds to wait between scans, when polling for file changes",
+			Value:  "60",
+			EnvVar: "LODESTONE_POLL_INTERVAL",
+		},
+		&cli.StringFlag{
+			Name:   "workers",
+			Usage:  "The number of workers hashing & publishing files (per watched directory)",
+			Value:  "4",
+			EnvVar: "LODESTONE_WORKERS",
+		},
+		&cli.StringFlag{
+			Name:   "queue-size",
+			Usage:  "The number of events each worker can queue before the watcher waits for it to catch up",
+			Value:  "100",
+			EnvVar: "LODESTONE_QUEUE_SIZE",
+		},
+		&cli.BoolFlag{
+			Name:   "mirror",
+			Usage:  "Upload new & changed files to the storage api (and delete removed files) before publishing events",
+			EnvVar: "LODESTONE_MIRROR",
+		},
+		&cli.StringFlag{
+			Name:   "api-endpoint",
+			Usage:  "The api server endpoint, used when mirroring files",
+			Value:  "http://webapp:3000",
+			EnvVar: "LODESTONE_API_ENDPOINT",
+		},
+		&cli.StringFlag{
+			Name:   "state-dir",
+			Usage:  "The directory where the file index is saved on shutdown, so changes made while stopped are published on restart",
+			EnvVar: "LODESTONE_STATE_DIR",
+		},
+	},
+}
+
+// parseRootSpec converts a watch root spec (semicolon separated key=value pairs) into a watcher config, filling in
+// any missing keys from the defaults. List values (include/exclude) are comma separated.
+func parseRootSpec(rootSpec string, defaults map[string]string, overrides map[string]string) (map[string]string, error) {
+	root := map[string]string{}
+	for key, value := range defaults {
+		root[key] = value
+	}
+	for key, value := range overrides {
+		root[key] = value
+	}
+
+	for _, pair := range strings.Split(rootSpec, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid root %q: expected key=value, got %q", rootSpec, pair)
+		}
+		key := strings.TrimSpace(keyValue[0])
+		if _, known := defaults[key]; !known && key != "dir" && key != "bucket" {
+			return nil, fmt.Errorf("invalid root %q: unknown key %q", rootSpec, key)
+		}
+		root[key] = strings.TrimSpace(keyValue[1])
+	}
+
+	if root["dir"] == "" {
+		return nil, fmt.Errorf("invalid root %q: dir is required", rootSpec)
+	}
+	if root["bucket"] == "" {
+		return nil, fmt.Errorf("invalid root %q: bucket is required", rootSpec)
+	}
+	return root, nil
+}
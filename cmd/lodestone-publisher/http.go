@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
+	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+)
+
+type healthResponse struct {
+	Status     string            `json:"status"`
+	Components []componentHealth `json:"components"`
+}
+
+type componentHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// startHttpServer serves the Prometheus metrics (/metrics), and the liveness (/healthz) & readiness (/readyz) checks
+// in the background. The caller must close the server.
+func startHttpServer(logger *logrus.Entry, address string, supervisor *watch.Supervisor, notifyClient notify.ReadinessChecker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	// live unless a source is stuck (eg. a deadlocked event loop), restarting the process may help
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, sourceComponents(supervisor.Liveness()))
+	})
+
+	// ready when events can be processed & published end to end
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		components := []componentHealth{newComponentHealth("broker", notifyClient.Ready())}
+		readiness := supervisor.Readiness()
+		if len(readiness) == 0 {
+			components = append(components, componentHealth{Name: "sources", Error: "no sources are running"})
+		}
+		writeHealth(w, append(components, sourceComponents(readiness)...))
+	})
+
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		logger.Infof("Serving metrics & health checks on %v", address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+func newComponentHealth(name string, err error) componentHealth {
+	component := componentHealth{Name: name, Healthy: err == nil}
+	if err != nil {
+		component.Error = err.Error()
+	}
+	return component
+}
+
+func sourceComponents(results map[string]error) []componentHealth {
+	components := []componentHealth{}
+	for name, err := range results {
+		components = append(components, newComponentHealth("source:"+name, err))
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components
+}
+
+// writeHealth responds with 200 if every component is healthy, or 503 otherwise
+func writeHealth(w http.ResponseWriter, components []componentHealth) {
+	response := healthResponse{Status: "ok", Components: components}
+	statusCode := http.StatusOK
+	for _, component := range components {
+		if !component.Healthy {
+			response.Status = "unhealthy"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/config"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The --config file (YAML, TOML or JSON) lists the sources to start, and can also contain the global settings (using
+// the global flag names). Each source's config uses the same keys as the matching subcommand's flags, eg.
+//
+//	amqp-url-file: /run/secrets/amqp_url
+//	sources:
+//	  - name: scanner
+//	    source: fs
+//	    config:
+//	      dir: /data/scans
+//	      bucket: documents
+//	  - name: receipts
+//	    source: email
+//	    config:
+//	      imap-hostname: imap.example.com
+//	      imap-password-file: /run/secrets/imap_password
+//	      bucket: finance
+//
+// Source config keys can be overridden with LODESTONE_SOURCE_<NAME>_<KEY> environment variables.
+// The file is reloaded on SIGHUP, or when it changes.
+var runCommand = cli.Command{
+	Name:  "run",
+	Usage: "Start every source listed in a config file, in a single process",
+	Action: func(c *cli.Context) error {
+		if c.String("config") == "" {
+			return errors.New("--config is required")
+		}
+		reloadInterval, err := strconv.Atoi(c.String("reload-interval"))
+		if err != nil || reloadInterval < 0 {
+			return fmt.Errorf("invalid --reload-interval %q", c.String("reload-interval"))
+		}
+
+		load := func() (*config.File, error) {
+			file, err := config.Load(c.String("config"))
+			if err != nil {
+				return nil, err
+			}
+
+			globalFlags := map[string]bool{}
+			for _, flag := range c.App.Flags {
+				globalFlags[flag.GetName()] = true
+			}
+			for key := range file.Settings {
+				if !globalFlags[key] {
+					return nil, fmt.Errorf("invalid config file %v: unknown setting %q", c.String("config"), key)
+				}
+			}
+			if globalSetting(c, file.Settings, "debug") == "true" {
+				logrus.SetLevel(logrus.DebugLevel)
+			} else {
+				logrus.SetLevel(logrus.InfoLevel)
+			}
+
+			if len(file.Sources) == 0 {
+				return nil, fmt.Errorf("no sources configured in %v", c.String("config"))
+			}
+			config.ApplyEnv(file.Sources, os.Environ())
+			return file, nil
+		}
+		return runSources(c, load, c.String("config"), time.Duration(reloadInterval)*time.Second)
+	},
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:   "config",
+			Usage:  fmt.Sprintf("The config file listing the sources to start (available sources: %v)", watch.Sources()),
+			EnvVar: "LODESTONE_CONFIG",
+		},
+		&cli.StringFlag{
+			Name:   "reload-interval",
+			Usage:  "The number of seconds between checks for config file changes, 0 to only reload on SIGHUP",
+			Value:  "10",
+			EnvVar: "LODESTONE_RELOAD_INTERVAL",
+		},
+	},
+}
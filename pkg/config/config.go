@@ -0,0 +1,259 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is prepended to every environment variable override
+const EnvPrefix = "LODESTONE_"
+
+// File is a parsed config file. Global settings use the same names as the global flags (eg. "amqp-url"), and each
+// source's config uses the same keys as the matching subcommand's flags. Lists may be written as arrays, and numbers
+// & booleans as native values, eg.
+//
+//	amqp-url-file: /run/secrets/amqp_url
+//	sources:
+//	  - name: scanner
+//	    source: fs
+//	    config:
+//	      dir: /data/scans
+//	      bucket: documents
+//	      include: ["*.pdf", "*.tif"]
+//	      workers: 8
+type File struct {
+	Settings map[string]string
+	Sources  []watch.SourceConfig
+}
+
+// Load reads a YAML (.yml, .yaml), TOML (.toml) or JSON (any other extension) config file.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	file, err := parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+	return file, nil
+}
+
+func parse(raw map[string]interface{}) (*File, error) {
+	file := &File{Settings: map[string]string{}}
+	for key, value := range raw {
+		if key != "sources" {
+			setting, err := stringValue(key, value)
+			if err != nil {
+				return nil, err
+			}
+			file.Settings[key] = setting
+			continue
+		}
+
+		sources, ok := value.([]interface{})
+		if !ok {
+			// TOML arrays of tables are decoded as []map[string]interface{}
+			tables, isTables := value.([]map[string]interface{})
+			if !isTables {
+				return nil, fmt.Errorf("%q must be a list of sources", key)
+			}
+			for _, table := range tables {
+				sources = append(sources, table)
+			}
+		}
+		for i, rawSource := range sources {
+			source, err := parseSource(rawSource)
+			if err != nil {
+				return nil, fmt.Errorf("sources[%d]: %v", i, err)
+			}
+			file.Sources = append(file.Sources, source)
+		}
+	}
+	return file, nil
+}
+
+func parseSource(rawSource interface{}) (watch.SourceConfig, error) {
+	fields, err := mapValue(rawSource)
+	if err != nil {
+		return watch.SourceConfig{}, err
+	}
+
+	source := watch.SourceConfig{Config: map[string]string{}}
+	for key, value := range fields {
+		switch key {
+		case "name":
+			source.Name, err = stringValue(key, value)
+		case "source":
+			source.Source, err = stringValue(key, value)
+		case "config":
+			var config map[string]interface{}
+			if config, err = mapValue(value); err != nil {
+				break
+			}
+			for configKey, configValue := range config {
+				if source.Config[configKey], err = stringValue(configKey, configValue); err != nil {
+					break
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return watch.SourceConfig{}, err
+		}
+	}
+
+	if source.Source == "" {
+		return watch.SourceConfig{}, fmt.Errorf("%q is required", "source")
+	}
+	if source.Name == "" {
+		source.Name = source.Source
+	}
+	return source, nil
+}
+
+// mapValue converts a decoded table/object into a map with string keys (yaml decodes them as interface{} keys)
+func mapValue(value interface{}) (map[string]interface{}, error) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, v := range m {
+			converted[fmt.Sprint(key)] = v
+		}
+		return converted, nil
+	default:
+		return nil, fmt.Errorf("expected a table, got %v", value)
+	}
+}
+
+// stringValue converts a decoded value into the string format used by the flags. Lists are comma separated.
+func stringValue(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			s, err := stringValue(key, item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("%q has an unsupported value: %v", key, value)
+	}
+}
+
+// EnvName is the environment variable that overrides a setting, eg. "amqp-url" is LODESTONE_AMQP_URL
+func EnvName(name string) string {
+	return EnvPrefix + envSegment(name)
+}
+
+func envSegment(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
+
+// ApplyEnv overrides source config keys with LODESTONE_SOURCE_<NAME>_<KEY> environment variables (environ is in the
+// os.Environ() format). The source name & key are upper cased, with any other characters replaced by underscores, eg.
+// LODESTONE_SOURCE_RECEIPTS_IMAP_PASSWORD sets "imap-password" for the "receipts" source.
+func ApplyEnv(sources []watch.SourceConfig, environ []string) {
+	// longest names first, so that "scans_archive" is not mistaken for the "scans" source
+	order := make([]int, len(sources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return len(sources[order[a]].Name) > len(sources[order[b]].Name)
+	})
+
+	for _, env := range environ {
+		keyValue := strings.SplitN(env, "=", 2)
+		if len(keyValue) != 2 || !strings.HasPrefix(keyValue[0], EnvPrefix+"SOURCE_") {
+			continue
+		}
+		for _, i := range order {
+			prefix := EnvPrefix + "SOURCE_" + envSegment(sources[i].Name) + "_"
+			if strings.HasPrefix(keyValue[0], prefix) {
+				key := strings.Replace(strings.ToLower(strings.TrimPrefix(keyValue[0], prefix)), "_", "-", -1)
+				sources[i].Config[key] = keyValue[1]
+				break
+			}
+		}
+	}
+}
+
+// ResolveSecrets replaces every "<key>-file" entry with a "<key>" entry containing the file's content, so that
+// secrets (eg. "imap-password-file") can be mounted as files rather than passed on the command line. Empty entries
+// are dropped.
+func ResolveSecrets(config map[string]string) error {
+	for key, path := range config {
+		if !strings.HasSuffix(key, "-file") {
+			continue
+		}
+		delete(config, key)
+		if path == "" {
+			continue
+		}
+		secretKey := strings.TrimSuffix(key, "-file")
+		if config[secretKey] != "" {
+			return &watch.ConfigError{Key: key, Reason: fmt.Sprintf("cannot be used together with %q", secretKey)}
+		}
+		secret, err := ReadSecret(path)
+		if err != nil {
+			return &watch.ConfigError{Key: key, Reason: err.Error()}
+		}
+		config[secretKey] = secret
+	}
+	return nil
+}
+
+// ReadSecret reads a secret file, ignoring the trailing newline
+func ReadSecret(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
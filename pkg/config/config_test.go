@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"github.com/analogj/lodestone-publisher/pkg/watch"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the same config, in each supported format
+var configFiles = map[string]string{
+	"config.yaml": `
+amqp-url-file: /run/secrets/amqp_url
+listen-address: ":9090"
+sources:
+  - name: scanner
+    source: fs
+    config:
+      dir: /data/scans
+      bucket: documents
+      include: ["*.pdf", "*.tif"]
+      workers: 8
+      mirror: true
+  - source: email
+    config:
+      imap-hostname: imap.example.com
+      attachment-max-size: 1.5
+`,
+	"config.toml": `
+amqp-url-file = "/run/secrets/amqp_url"
+listen-address = ":9090"
+
+[[sources]]
+name = "scanner"
+source = "fs"
+[sources.config]
+dir = "/data/scans"
+bucket = "documents"
+include = ["*.pdf", "*.tif"]
+workers = 8
+mirror = true
+
+[[sources]]
+source = "email"
+[sources.config]
+imap-hostname = "imap.example.com"
+attachment-max-size = 1.5
+`,
+	"config.json": `{
+  "amqp-url-file": "/run/secrets/amqp_url",
+  "listen-address": ":9090",
+  "sources": [
+    {
+      "name": "scanner",
+      "source": "fs",
+      "config": {"dir": "/data/scans", "bucket": "documents", "include": ["*.pdf", "*.tif"], "workers": 8, "mirror": true}
+    },
+    {"source": "email", "config": {"imap-hostname": "imap.example.com", "attachment-max-size": 1.5}}
+  ]
+}`,
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	want := &File{
+		Settings: map[string]string{
+			"amqp-url-file":  "/run/secrets/amqp_url",
+			"listen-address": ":9090",
+		},
+		Sources: []watch.SourceConfig{
+			{Name: "scanner", Source: "fs", Config: map[string]string{
+				"dir":     "/data/scans",
+				"bucket":  "documents",
+				"include": "*.pdf,*.tif",
+				"workers": "8",
+				"mirror":  "true",
+			}},
+			// the name defaults to the source type
+			{Name: "email", Source: "email", Config: map[string]string{
+				"imap-hostname":       "imap.example.com",
+				"attachment-max-size": "1.5",
+			}},
+		},
+	}
+	for name, content := range configFiles {
+		t.Run(name, func(t *testing.T) {
+			file, err := Load(writeFile(t, name, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(file, want) {
+				t.Errorf("Load() = %+v, want %+v", file, want)
+			}
+		})
+	}
+}
+
+func TestLoadYamlAnchors(t *testing.T) {
+	file, err := Load(writeFile(t, "config.yml", `
+sources:
+  - name: inbox
+    source: email
+    config: &account
+      imap-hostname: imap.example.com
+      imap-username: documents
+  - name: receipts
+    source: email
+    config:
+      <<: *account
+      imap-folder: Receipts
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Sources) != 2 {
+		t.Fatalf("got %d sources, want 2", len(file.Sources))
+	}
+	if got := file.Sources[1].Config; got["imap-hostname"] != "imap.example.com" || got["imap-folder"] != "Receipts" {
+		t.Errorf("merged config = %v", got)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{"invalid yaml", "c.yaml", "sources: [", "invalid config file"},
+		{"invalid json", "c.json", "{", "invalid config file"},
+		{"invalid toml", "c.toml", "sources = [", "invalid config file"},
+		{"sources is not a list", "c.yaml", "sources: fs", `"sources" must be a list of sources`},
+		{"source is not a table", "c.yaml", "sources: [fs]", "sources[0]: expected a table"},
+		{"missing source type", "c.yaml", "sources: [{name: scans}]", `sources[0]: "source" is required`},
+		{"unknown source key", "c.yaml", "sources: [{source: fs, dir: /data}]", `sources[0]: unknown key "dir"`},
+		{"unsupported setting", "c.yaml", "amqp-url: {host: broker}", `"amqp-url" has an unsupported value`},
+		{"unsupported config value", "c.yaml", "sources: [{source: fs, config: {dir: {path: /data}}}]", `"dir" has an unsupported value`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Load(writeFile(t, test.file, test.content))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Load() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Load() of a missing file should fail")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"amqp-url":       "LODESTONE_AMQP_URL",
+		"listen-address": "LODESTONE_LISTEN_ADDRESS",
+		"otlp.endpoint":  "LODESTONE_OTLP_ENDPOINT",
+	}
+	for name, want := range tests {
+		if got := EnvName(name); got != want {
+			t.Errorf("EnvName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	sources := []watch.SourceConfig{
+		{Name: "scans", Config: map[string]string{"dir": "/data/scans"}},
+		{Name: "scans-archive", Config: map[string]string{"dir": "/data/archive"}},
+		{Name: "receipts", Config: map[string]string{}},
+	}
+	ApplyEnv(sources, []string{
+		"LODESTONE_SOURCE_SCANS_DIR=/mnt/scans",
+		"LODESTONE_SOURCE_SCANS_ARCHIVE_WORKERS=2",
+		"LODESTONE_SOURCE_RECEIPTS_IMAP_PASSWORD=p=ss",
+		"LODESTONE_SOURCE_UNKNOWN_DIR=/tmp",
+		"LODESTONE_AMQP_URL=amqp://broker",
+		"SOURCE_SCANS_BUCKET=other",
+		"LODESTONE_SOURCE_SCANS_INVALID",
+	})
+
+	want := []map[string]string{
+		{"dir": "/mnt/scans"},
+		{"dir": "/data/archive", "workers": "2"},
+		{"imap-password": "p=ss"},
+	}
+	for i, source := range sources {
+		if !reflect.DeepEqual(source.Config, want[i]) {
+			t.Errorf("%v config = %v, want %v", source.Name, source.Config, want[i])
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	secret := writeFile(t, "password", "s3cret\n")
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name    string
+		config  map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "secret file",
+			config: map[string]string{"imap-password-file": secret, "imap-username": "documents"},
+			want:   map[string]string{"imap-password": "s3cret", "imap-username": "documents"},
+		},
+		{
+			name:   "empty secret file setting is dropped",
+			config: map[string]string{"imap-password-file": "", "imap-password": "plain"},
+			want:   map[string]string{"imap-password": "plain"},
+		},
+		{
+			name:    "both the secret and the file",
+			config:  map[string]string{"imap-password-file": secret, "imap-password": "plain"},
+			wantErr: `invalid config "imap-password-file": cannot be used together with "imap-password"`,
+		},
+		{
+			name:    "missing secret file",
+			config:  map[string]string{"imap-password-file": missing},
+			wantErr: `invalid config "imap-password-file": open ` + missing,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ResolveSecrets(test.config)
+			if test.wantErr != "" {
+				var configErr *watch.ConfigError
+				if !errors.As(err, &configErr) || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Errorf("ResolveSecrets() error = %v, want a ConfigError starting with %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.config, test.want) {
+				t.Errorf("config = %v, want %v", test.config, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	tests := map[string]string{
+		"secret":         "secret",
+		"secret\n":       "secret",
+		"secret\r\n":     "secret",
+		"two\nlines\n\n": "two\nlines",
+		" spaces \n":     " spaces ",
+	}
+	for content, want := range tests {
+		got, err := ReadSecret(writeFile(t, "secret", content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("ReadSecret(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+)
+
+const namespace = "lodestone_publisher"
+
+var (
+	// Events, by event source (eg. "fs"), bucket and S3 event name
+	EventsSeen = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_seen_total",
+		Help:      "Events detected by the sources, before they are processed.",
+	}, []string{"source", "bucket", "event"})
+	EventsPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_published_total",
+		Help:      "Events published to the broker.",
+	}, []string{"source", "bucket", "event"})
+	EventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_failed_total",
+		Help:      "Events that could not be processed or published.",
+	}, []string{"source", "bucket", "event"})
+
+	// AMQP notifier
+	PublishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_duration_seconds",
+		Help:      "Time taken to publish an event, until the broker confirmed it.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	PublishRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publish_retries_total",
+		Help:      "Publishes that were retried, by reason (error, nack or timeout).",
+	}, []string{"reason"})
+	BrokerConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "broker_connected",
+		Help:      "1 if the notifier is connected to the broker and ready to publish, 0 otherwise.",
+	})
+
+	// File hashing
+	HashDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hash_duration_seconds",
+		Help:      "Time taken to hash a file.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	HashedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hashed_bytes_total",
+		Help:      "Bytes read while hashing files.",
+	})
+
+	// Filesystem watcher
+	WatchedDirectories = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watched_directories",
+		Help:      "Directories with an active watch, by watched root.",
+	}, []string{"dir"})
+	WorkerQueuedJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_queued_jobs",
+		Help:      "Events waiting for a hashing & publishing worker, by watched root.",
+	}, []string{"dir"})
+	WorkerInFlightJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "worker_in_flight_jobs",
+		Help:      "Events being hashed & published by the workers, by watched root.",
+	}, []string{"dir"})
+	WorkerBlockedSubmits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_blocked_submits_total",
+		Help:      "Events the watcher had to wait to queue because a worker's queue was full, by watched root.",
+	}, []string{"dir"})
+	WorkerBlockedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_blocked_seconds_total",
+		Help:      "Time the watcher spent waiting for queue space (backpressure), by watched root.",
+	}, []string{"dir"})
+
+	// Email watcher
+	ImapMessagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_messages_fetched_total",
+		Help:      "Messages fetched from the imap server, by account and mailbox.",
+	}, []string{"account", "mailbox"})
+	AttachmentsUploaded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_uploaded_total",
+		Help:      "Email attachments uploaded to the storage api, by account and mailbox.",
+	}, []string{"account", "mailbox"})
+	AttachmentsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "attachments_skipped_total",
+		Help:      "Email attachments skipped by the attachment rules, by account, mailbox and rule (name, extension, size or type).",
+	}, []string{"account", "mailbox", "rule"})
+	MessagesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_rejected_total",
+		Help:      "Messages rejected by the sender checks, by account, mailbox and check (sender, spf or dkim).",
+	}, []string{"account", "mailbox", "check"})
+
+	// Storage api
+	StorageRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_requests_total",
+		Help:      "Requests to the storage api, by method and status code (\"error\" if no response was received).",
+	}, []string{"method", "code"})
+)
+
+// ObserveStorageRequest records the response of a storage api request. The status code is ignored if err is not nil.
+func ObserveStorageRequest(method string, statusCode int, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(statusCode)
+	}
+	StorageRequests.WithLabelValues(method, code).Inc()
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
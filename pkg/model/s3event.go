@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
 	"io"
 	"net"
 	"os"
@@ -140,6 +141,11 @@ func localIP() string {
 	return ""
 }
 
+// FileMD5Hash returns the hex encoded MD5 hash of the file, ie. the ETag of the object once uploaded
+func FileMD5Hash(filePath string) (string, error) {
+	return fileMD5Hash(filePath)
+}
+
 func fileMD5Hash(filePath string) (string, error) {
 	//Initialize variable returnMD5String now in case an error has to be returned
 	var returnMD5String string
@@ -157,9 +163,13 @@ func fileMD5Hash(filePath string) (string, error) {
 	hash := md5.New()
 
 	//Copy the file in the hash interface and check for any error
-	if _, err := io.Copy(hash, file); err != nil {
+	start := time.Now()
+	hashedBytes, err := io.Copy(hash, file)
+	metrics.HashedBytes.Add(float64(hashedBytes))
+	if err != nil {
 		return returnMD5String, err
 	}
+	metrics.HashDuration.Observe(time.Since(start).Seconds())
 
 	//Get the 16 bytes hash
 	hashInBytes := hash.Sum(nil)[:16]
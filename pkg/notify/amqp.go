@@ -1,11 +1,18 @@
 package notify
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
 	"github.com/analogj/lodestone-publisher/pkg/model"
+	"github.com/analogj/lodestone-publisher/pkg/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,15 +21,32 @@ import (
 type AmqpNotify struct {
 	logger   *logrus.Entry
 	client   *amqp.Connection
-	channel  *amqp.Channel
+	channel  amqpChannel
 	exchange string
 	queue    string
 
 	done            chan bool
 	notifyConnClose chan *amqp.Error
 	notifyChanClose chan *amqp.Error
-	notifyConfirm   chan amqp.Confirmation
-	isReady         bool
+	// 1 while connected, accessed atomically: it is set by the reconnect loop, and read by publishers & readiness checks
+	isReady int32
+
+	// publishes are not serialized while waiting for their confirmation: each publisher waits for the confirmation
+	// with its delivery tag, so that any number of events can be in flight on the channel.
+	// publishMutex assigns the delivery tags in the order messages are published, confirmMutex protects the publishers
+	// waiting for a confirmation. The confirmations are never blocked by a publish.
+	publishMutex    sync.Mutex
+	nextDeliveryTag uint64
+	confirmMutex    sync.Mutex
+	confirms        map[uint64]chan bool
+}
+
+// amqpChannel is the part of *amqp.Channel used to publish, so that confirm handling can be tested without a broker
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Close() error
 }
 
 const (
@@ -46,6 +70,7 @@ func (n *AmqpNotify) Init(logger *logrus.Entry, config map[string]string) error
 	n.exchange = config["exchange"]
 	n.queue = config["queue"]
 	n.logger = logger
+	n.done = make(chan bool)
 
 	go n.handleReconnect(config["amqp-url"])
 	return nil
@@ -55,7 +80,8 @@ func (n *AmqpNotify) Init(logger *logrus.Entry, config map[string]string) error
 // notifyConnClose, and then continuously attempt to reconnect.
 func (n *AmqpNotify) handleReconnect(addr string) {
 	for {
-		n.isReady = false
+		n.setReady(false)
+		metrics.BrokerConnected.Set(0)
 		n.logger.Infoln("Attempting to connect")
 
 		conn, err := n.connect(addr)
@@ -94,7 +120,8 @@ func (n *AmqpNotify) connect(addr string) (*amqp.Connection, error) {
 // and then continuously attempt to re-initialize both channels
 func (n *AmqpNotify) handleReInit(conn *amqp.Connection) bool {
 	for {
-		n.isReady = false
+		n.setReady(false)
+		metrics.BrokerConnected.Set(0)
 
 		err := n.init(conn)
 
@@ -161,7 +188,8 @@ func (n *AmqpNotify) init(conn *amqp.Connection) error {
 	}
 
 	n.changeChannel(ch)
-	n.isReady = true
+	n.setReady(true)
+	metrics.BrokerConnected.Set(1)
 	n.logger.Debugln("Setup!")
 
 	return nil
@@ -177,21 +205,87 @@ func (n *AmqpNotify) changeClient(client *amqp.Connection) {
 
 // changeChannel takes a new channel to the queue,
 // and updates the channel listeners to reflect this.
-func (n *AmqpNotify) changeChannel(channel *amqp.Channel) {
+// Delivery tags start over on the new channel, so publishers still waiting for a confirmation on the previous channel
+// are told to retry.
+func (n *AmqpNotify) changeChannel(channel amqpChannel) {
+	n.publishMutex.Lock()
+	defer n.publishMutex.Unlock()
+	n.confirmMutex.Lock()
+	defer n.confirmMutex.Unlock()
+
+	for _, confirmed := range n.confirms {
+		close(confirmed)
+	}
+	n.confirms = map[uint64]chan bool{}
+	n.nextDeliveryTag = 1
+
 	n.channel = channel
 	n.notifyChanClose = make(chan *amqp.Error)
-	n.notifyConfirm = make(chan amqp.Confirmation, 1)
+	notifyConfirm := make(chan amqp.Confirmation, 1)
 	n.channel.NotifyClose(n.notifyChanClose)
-	n.channel.NotifyPublish(n.notifyConfirm)
+	n.channel.NotifyPublish(notifyConfirm)
+	go n.dispatchConfirms(channel, notifyConfirm)
+}
+
+// dispatchConfirms hands each confirmation to the publisher waiting for its delivery tag, until the channel is closed.
+func (n *AmqpNotify) dispatchConfirms(channel amqpChannel, notifyConfirm chan amqp.Confirmation) {
+	for confirm := range notifyConfirm {
+		n.confirmMutex.Lock()
+		if n.channel == channel {
+			if confirmed, ok := n.confirms[confirm.DeliveryTag]; ok {
+				confirmed <- confirm.Ack
+				delete(n.confirms, confirm.DeliveryTag)
+			}
+		}
+		n.confirmMutex.Unlock()
+	}
+}
+
+// forgetConfirm stops waiting for the confirmation of a delivery tag, eg. when it timed out and will be resent
+func (n *AmqpNotify) forgetConfirm(channel amqpChannel, deliveryTag uint64) {
+	n.confirmMutex.Lock()
+	defer n.confirmMutex.Unlock()
+	if n.channel == channel {
+		delete(n.confirms, deliveryTag)
+	}
+}
+
+func (n *AmqpNotify) setReady(ready bool) {
+	if ready {
+		atomic.StoreInt32(&n.isReady, 1)
+	} else {
+		atomic.StoreInt32(&n.isReady, 0)
+	}
+}
+
+func (n *AmqpNotify) ready() bool {
+	return atomic.LoadInt32(&n.isReady) == 1
+}
+
+// Ready returns an error while the notifier is not connected to the broker (eg. while reconnecting)
+func (n *AmqpNotify) Ready() error {
+	if !n.ready() {
+		return errNotConnected
+	}
+	return nil
 }
 
 // Publish will push data onto the queue, and wait for a confirm.
 // If no confirms are received until within the resendTimeout,
 // it continuously re-sends messages until a confirm is received.
-// This will block until the server sends a confirm. Errors are
+// This will block until the server sends a confirm, or ctx is cancelled. Errors are
 // only returned if the push action itself fails, see UnsafePush.
-func (n *AmqpNotify) Publish(event model.S3Event) error {
-	if !n.isReady {
+// Publish can be called concurrently, the confirms of concurrent publishes are awaited in parallel.
+// The trace context of ctx is sent in the message headers (W3C traceparent), so the consumer can continue the trace.
+func (n *AmqpNotify) Publish(ctx context.Context, event model.S3Event) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "amqp.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.String("messaging.destination", n.exchange),
+		attribute.String("messaging.rabbitmq.routing_key", n.queue),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	if !n.ready() {
 		return errors.New("failed to publish event: not connected")
 	}
 
@@ -202,24 +296,51 @@ func (n *AmqpNotify) Publish(event model.S3Event) error {
 		return err
 	}
 
+	headers := amqp.Table{}
+	tracing.Inject(ctx, amqpHeaderCarrier(headers))
+
+	start := time.Now()
 	for {
-		err := n.unsafePublish(b)
+		channel, deliveryTag, confirmed, err := n.unsafePublish(b, headers)
 		if err != nil {
 			n.logger.Println("Publish failed. Retrying...")
+			metrics.PublishRetries.WithLabelValues("error").Inc()
+			span.AddEvent("retry", trace.WithAttributes(attribute.String("reason", "error"), attribute.String("error", err.Error())))
 			select {
 			case <-n.done:
 				return errShutdown
+			case <-ctx.Done():
+				return ctx.Err()
 			case <-time.After(resendDelay):
 			}
 			continue
 		}
 		select {
-		case confirm := <-n.notifyConfirm:
-			if confirm.Ack {
+		case ack, ok := <-confirmed:
+			if ack {
 				n.logger.Println("Publish confirmed!")
+				metrics.PublishDuration.Observe(time.Since(start).Seconds())
+				span.AddEvent("confirmed")
 				return nil
 			}
+			if !ok {
+				// the channel was closed before the confirmation arrived
+				metrics.PublishRetries.WithLabelValues("error").Inc()
+				span.AddEvent("retry", trace.WithAttributes(attribute.String("reason", "channel closed")))
+				break
+			}
+			metrics.PublishRetries.WithLabelValues("nack").Inc()
+			span.AddEvent("retry", trace.WithAttributes(attribute.String("reason", "nack")))
+		case <-n.done:
+			n.forgetConfirm(channel, deliveryTag)
+			return errShutdown
+		case <-ctx.Done():
+			n.forgetConfirm(channel, deliveryTag)
+			return ctx.Err()
 		case <-time.After(resendDelay):
+			n.forgetConfirm(channel, deliveryTag)
+			metrics.PublishRetries.WithLabelValues("timeout").Inc()
+			span.AddEvent("retry", trace.WithAttributes(attribute.String("reason", "timeout")))
 		}
 		n.logger.Println("Publish didn't confirm. Retrying...")
 	}
@@ -229,35 +350,80 @@ func (n *AmqpNotify) Publish(event model.S3Event) error {
 // confirmation. It returns an error if it fails to connect.
 // No guarantees are provided for whether the server will
 // recieve the message.
-func (n *AmqpNotify) unsafePublish(data []byte) error {
-	if !n.isReady {
-		return errNotConnected
+// The returned chan receives the confirmation (true for an ack) of the message's delivery tag on the channel, and is
+// closed if the channel is replaced before the confirmation arrives.
+func (n *AmqpNotify) unsafePublish(data []byte, headers amqp.Table) (amqpChannel, uint64, <-chan bool, error) {
+	if !n.ready() {
+		return nil, 0, nil, errNotConnected
 	}
-	return n.channel.Publish(
+
+	// delivery tags are assigned in the order messages are published on the channel. The publisher is registered
+	// before publishing, as the confirmation can arrive before Publish returns.
+	n.publishMutex.Lock()
+	defer n.publishMutex.Unlock()
+	channel := n.channel
+	deliveryTag := n.nextDeliveryTag
+	confirmed := make(chan bool, 1)
+	n.confirmMutex.Lock()
+	n.confirms[deliveryTag] = confirmed
+	n.confirmMutex.Unlock()
+
+	err := channel.Publish(
 		n.exchange, // exchange
 		n.queue,    // routing key
 		false,      // Mandatory
 		false,      // Immediate
 		amqp.Publishing{
+			Headers:     headers,
 			ContentType: "application/json",
 			Body:        data,
 		},
 	)
+	if err != nil {
+		n.forgetConfirm(channel, deliveryTag)
+		return nil, 0, nil, err
+	}
+	n.nextDeliveryTag++
+	return channel, deliveryTag, confirmed, nil
 }
 
+// amqpHeaderCarrier lets the trace context be written to (and read from) the message headers
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops reconnecting, aborts any publishes that are still waiting for a confirmation, and closes the
+// connection.
 func (n *AmqpNotify) Close() error {
-	if !n.isReady {
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+
+	if !n.ready() {
 		return errAlreadyClosed
 	}
+	n.setReady(false)
+	metrics.BrokerConnected.Set(0)
 	err := n.channel.Close()
 	if err != nil {
 		return err
 	}
-	err = n.client.Close()
-	if err != nil {
-		return err
-	}
-	close(n.done)
-	n.isReady = false
-	return nil
+	return n.client.Close()
 }
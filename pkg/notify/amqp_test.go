@@ -0,0 +1,196 @@
+package notify
+
+import (
+	"context"
+	"github.com/analogj/lodestone-publisher/pkg/model"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChannel records the published messages, confirmations are sent by the test
+type fakeChannel struct {
+	mutex     sync.Mutex
+	published int
+	confirm   chan amqp.Confirmation
+}
+
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.published++
+	return nil
+}
+
+func (ch *fakeChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return c
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirm = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) Close() error {
+	return nil
+}
+
+// waitPublished blocks until the number of messages were published on the channel
+func (ch *fakeChannel) waitPublished(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ch.mutex.Lock()
+		published := ch.published
+		ch.mutex.Unlock()
+		if published == count {
+			return
+		}
+		if published > count || time.Now().After(deadline) {
+			t.Fatalf("published %d messages, want %d", published, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (ch *fakeChannel) ack(deliveryTag uint64, ack bool) {
+	ch.confirm <- amqp.Confirmation{DeliveryTag: deliveryTag, Ack: ack}
+}
+
+func newTestNotify(t *testing.T) (*AmqpNotify, *fakeChannel) {
+	n := &AmqpNotify{logger: logrus.NewEntry(logrus.New()), done: make(chan bool)}
+	channel := &fakeChannel{}
+	n.changeChannel(channel)
+	n.setReady(true)
+	t.Cleanup(func() { close(channel.confirm) })
+	return n, channel
+}
+
+// publishAsync publishes in the background, the result is sent on the returned chan
+func publishAsync(n *AmqpNotify) chan error {
+	return publishAsyncContext(context.Background(), n)
+}
+
+func publishAsyncContext(ctx context.Context, n *AmqpNotify) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- n.Publish(ctx, model.S3Event{})
+	}()
+	return result
+}
+
+func expectResult(t *testing.T, result chan error, want error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		if err != want {
+			t.Errorf("Publish() = %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish() did not return")
+	}
+}
+
+func expectWaiting(t *testing.T, n *AmqpNotify, want int) {
+	t.Helper()
+	n.confirmMutex.Lock()
+	defer n.confirmMutex.Unlock()
+	if len(n.confirms) != want {
+		t.Errorf("%d publishes waiting for a confirmation, want %d", len(n.confirms), want)
+	}
+}
+
+func TestAmqpPublishesAreConfirmedInParallel(t *testing.T) {
+	n, channel := newTestNotify(t)
+
+	results := []chan error{publishAsync(n), publishAsync(n), publishAsync(n)}
+	// all messages are in flight before the first confirmation
+	channel.waitPublished(t, 3)
+	expectWaiting(t, n, 3)
+
+	// confirmations can arrive in any order, each one only releases its own publisher
+	channel.ack(2, true)
+	channel.ack(3, true)
+	channel.ack(1, true)
+	for _, result := range results {
+		expectResult(t, result, nil)
+	}
+	expectWaiting(t, n, 0)
+}
+
+func TestAmqpNackIsRepublished(t *testing.T) {
+	n, channel := newTestNotify(t)
+
+	result := publishAsync(n)
+	channel.waitPublished(t, 1)
+	channel.ack(1, false)
+
+	// the message is published again, with the next delivery tag
+	channel.waitPublished(t, 2)
+	channel.ack(2, true)
+	expectResult(t, result, nil)
+	expectWaiting(t, n, 0)
+}
+
+func TestAmqpPublishesAreRetriedOnANewChannel(t *testing.T) {
+	n, channel := newTestNotify(t)
+
+	results := []chan error{publishAsync(n), publishAsync(n)}
+	channel.waitPublished(t, 2)
+
+	// the channel is replaced (eg. after a reconnect), before the messages were confirmed
+	reopened := &fakeChannel{}
+	n.changeChannel(reopened)
+	defer close(reopened.confirm)
+
+	// both messages are published again on the new channel, where delivery tags start over
+	reopened.waitPublished(t, 2)
+	expectWaiting(t, n, 2)
+
+	// late confirmations from the old channel are ignored
+	channel.ack(1, true)
+	channel.ack(2, true)
+	time.Sleep(10 * time.Millisecond)
+	expectWaiting(t, n, 2)
+
+	reopened.ack(1, true)
+	reopened.ack(2, true)
+	for _, result := range results {
+		expectResult(t, result, nil)
+	}
+	expectWaiting(t, n, 0)
+}
+
+func TestAmqpPublishStopsOnShutdown(t *testing.T) {
+	n, channel := newTestNotify(t)
+
+	result := publishAsync(n)
+	channel.waitPublished(t, 1)
+	close(n.done)
+	expectResult(t, result, errShutdown)
+	expectWaiting(t, n, 0)
+}
+
+func TestAmqpPublishStopsWhenCancelled(t *testing.T) {
+	n, channel := newTestNotify(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := publishAsyncContext(ctx, n)
+	channel.waitPublished(t, 1)
+	cancel()
+	expectResult(t, result, context.Canceled)
+	expectWaiting(t, n, 0)
+}
+
+func TestAmqpPublishWhileNotConnected(t *testing.T) {
+	n, _ := newTestNotify(t)
+	n.setReady(false)
+	if err := n.Ready(); err != errNotConnected {
+		t.Errorf("Ready() = %v, want %v", err, errNotConnected)
+	}
+	if err := n.Publish(context.Background(), model.S3Event{}); err == nil {
+		t.Error("Publish() succeeded while not connected")
+	}
+}
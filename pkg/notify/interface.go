@@ -1,12 +1,18 @@
 package notify
 
 import (
+	"context"
 	"github.com/analogj/lodestone-publisher/pkg/model"
 	"github.com/sirupsen/logrus"
 )
 
+// ReadinessChecker is implemented by notifiers that can report whether they are able to publish
+type ReadinessChecker interface {
+	Ready() error
+}
+
 type Interface interface {
 	Init(logger *logrus.Entry, config map[string]string) error
-	Publish(event model.S3Event) error
+	Publish(ctx context.Context, event model.S3Event) error
 	Close() error
 }
@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"context"
+	"github.com/analogj/lodestone-publisher/pkg/model"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// Reloadable forwards events to a notifier that can be replaced at runtime (eg. when the config is reloaded), without
+// restarting the sources that publish through it.
+type Reloadable struct {
+	mutex   sync.RWMutex
+	current Interface
+}
+
+func NewReloadable(current Interface) *Reloadable {
+	return &Reloadable{current: current}
+}
+
+// Init initializes the current notifier
+func (r *Reloadable) Init(logger *logrus.Entry, config map[string]string) error {
+	return r.notifier().Init(logger, config)
+}
+
+// Publish sends the event using the current notifier. If the notifier is replaced while the event is being published
+// (aborting the publish), it is retried with the new notifier.
+func (r *Reloadable) Publish(ctx context.Context, event model.S3Event) error {
+	for {
+		notifier := r.notifier()
+		err := notifier.Publish(ctx, event)
+		if err == nil || notifier == r.notifier() {
+			return err
+		}
+	}
+}
+
+// Ready checks the current notifier, if it supports readiness checks
+func (r *Reloadable) Ready() error {
+	if checker, ok := r.notifier().(ReadinessChecker); ok {
+		return checker.Ready()
+	}
+	return nil
+}
+
+func (r *Reloadable) Close() error {
+	return r.notifier().Close()
+}
+
+// Swap replaces the current notifier (which must already be initialized), and closes the previous one
+func (r *Reloadable) Swap(next Interface) error {
+	r.mutex.Lock()
+	previous := r.current
+	r.current = next
+	r.mutex.Unlock()
+	return previous.Close()
+}
+
+func (r *Reloadable) notifier() Interface {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.current
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
+	"github.com/analogj/lodestone-publisher/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// When checking if the storage api is reachable
+const pingTimeout = 5 * time.Second
+
+// Any request (including the upload of the file) that takes longer fails, so that a hung connection does not block
+// the caller (eg. a publish worker) forever. Long enough to upload large scans over a slow link.
+const requestTimeout = 5 * time.Minute
+
+// Client stores & removes objects using the Lodestone storage api (/api/v1/storage/{bucket}/{key})
+type Client struct {
+	apiEndpoint string
+	httpClient  *http.Client
+}
+
+func NewClient(apiEndpoint string) *Client {
+	return &Client{
+		apiEndpoint: apiEndpoint,
+		httpClient:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Upload streams the local file to the storage api. Any non 2xx response is treated as an error.
+func (c *Client) Upload(ctx context.Context, bucket string, key string, localFilepath string) (err error) {
+	ctx, span := startSpan(ctx, "storage.upload", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	localFile, err := os.Open(localFilepath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	fileInfo, err := localFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	objectUrl, err := c.objectUrl(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, objectUrl, localFile)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fileInfo.Size()
+	req.Header.Set("Content-Type", "binary/octet-stream")
+	span.SetAttributes(attribute.Int64("storage.size", fileInfo.Size()))
+
+	return c.do(req.WithContext(ctx))
+}
+
+// Delete removes the object from the storage api. Objects that do not exist are not treated as an error.
+func (c *Client) Delete(ctx context.Context, bucket string, key string) (err error) {
+	ctx, span := startSpan(ctx, "storage.delete", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	objectUrl, err := c.objectUrl(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, objectUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(req.WithContext(ctx))
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// ObjectInfo describes an object stored by the storage api
+type ObjectInfo struct {
+	ETag string
+	Size int64
+}
+
+// Stat returns the ETag & size of the object, or nil if it does not exist.
+func (c *Client) Stat(ctx context.Context, bucket string, key string) (info *ObjectInfo, err error) {
+	ctx, span := startSpan(ctx, "storage.stat", bucket, key)
+	defer func() { tracing.End(span, err) }()
+
+	objectUrl, err := c.objectUrl(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, objectUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(req.WithContext(ctx))
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{ETag: strings.Trim(resp.Header.Get("ETag"), `"`), Size: resp.ContentLength}, nil
+}
+
+// Ping checks that the storage api is reachable. Any response other than a server error (5xx) counts as reachable.
+func (c *Client) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodHead, c.apiEndpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(req.WithContext(ctx))
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode < 500 {
+		return nil
+	}
+	return err
+}
+
+// StatusError is returned when the storage api responds with a non 2xx status code
+type StatusError struct {
+	Method     string
+	Url        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("storage api %s %s failed: %d %s", e.Method, e.Url, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Helpers
+
+func startSpan(ctx context.Context, name string, bucket string, key string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("storage.bucket", bucket),
+		attribute.String("storage.key", key),
+	))
+}
+
+func (c *Client) objectUrl(bucket string, key string) (string, error) {
+	//manipulate the path
+	apiEndpoint, err := url.Parse(c.apiEndpoint)
+	if err != nil {
+		return "", err
+	}
+	apiEndpoint.Path = fmt.Sprintf("/api/v1/storage/%s/%s", bucket, key)
+	return apiEndpoint.String(), nil
+}
+
+// do sends the request, with the trace context of the request context in the headers (W3C traceparent)
+func (c *Client) do(req *http.Request) error {
+	_, err := c.send(req)
+	return err
+}
+
+// send is like do, but returns the response (with its body closed) for the headers
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	tracing.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		metrics.ObserveStorageRequest(req.Method, 0, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	metrics.ObserveStorageRequest(req.Method, resp.StatusCode, nil)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, &StatusError{Method: req.Method, Url: req.URL.String(), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
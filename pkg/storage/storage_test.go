@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientRequestsTimeOut(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the storage api hangs
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewClient(server.URL)
+	if client.httpClient.Timeout != requestTimeout {
+		t.Errorf("timeout = %v, want %v", client.httpClient.Timeout, requestTimeout)
+	}
+	client.httpClient.Timeout = 50 * time.Millisecond
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.Stat(context.Background(), "bucket", "key")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Stat() of a hung request succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stat() did not time out")
+	}
+}
+
+func TestClientRequestsAreCancelled(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- NewClient(server.URL).Delete(ctx, "bucket", "key")
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Delete() of a cancelled request succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delete() was not cancelled")
+	}
+}
@@ -0,0 +1,281 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError names the config key that failed validation
+type ConfigError struct {
+	Key    string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config %q: %s", e.Key, e.Reason)
+}
+
+// FsConfig is the typed config for the "fs" source
+type FsConfig struct {
+	Dir     string
+	Bucket  string
+	Prefix  string
+	Source  string
+	Include []string
+	Exclude []string
+
+	WatchMode    string
+	PollInterval time.Duration
+
+	Workers   int
+	QueueSize int
+
+	Mirror      bool
+	ApiEndpoint string
+
+	StateDir        string
+	ShutdownTimeout time.Duration
+}
+
+// ParseFsConfig validates the "fs" source config. Empty values use the defaults.
+func ParseFsConfig(config map[string]string) (FsConfig, error) {
+	p := newConfigParser(config)
+	fsConfig := FsConfig{
+		Dir:     p.Required("dir"),
+		Bucket:  p.Required("bucket"),
+		Prefix:  p.String("prefix", ""),
+		Source:  p.String("source", "fs"),
+		Include: p.List("include"),
+		Exclude: p.List("exclude"),
+
+		WatchMode:    p.OneOf("watch-mode", "auto", "auto", "inotify", "poll"),
+		PollInterval: p.Seconds("poll-interval", 60, 1),
+
+		Workers:   p.Int("workers", 4, 1),
+		QueueSize: p.Int("queue-size", 100, 0),
+
+		Mirror:      p.Bool("mirror", false),
+		ApiEndpoint: p.String("api-endpoint", "http://webapp:3000"),
+
+		StateDir:        p.String("state-dir", ""),
+		ShutdownTimeout: p.Seconds("shutdown-timeout", 30, 0),
+	}
+	return fsConfig, p.Err()
+}
+
+// EmailConfig is the typed config for the "email" source
+type EmailConfig struct {
+	ImapHostname string
+	ImapPort     int
+	ImapUsername string
+	ImapPassword string
+	ImapFolder   string
+	ImapInterval time.Duration
+	ImapIdle     bool
+
+	// what to do with processed messages: "delete", "move" (to ProcessedFolder) or "flag" (with ProcessedFlag)
+	PostProcess     string
+	ProcessedFolder string
+	ProcessedFlag   string
+	// what to do with messages that failed: "move" (to FailedFolder) or "keep" (retried by the next check)
+	OnFailure    string
+	FailedFolder string
+
+	// sender checks, see checkSender
+	AllowSenders []string
+	DenySenders  []string
+	RequireSpf   bool
+	RequireDkim  bool
+	AuthservId   string
+
+	// attachment rules, see checkAttachmentName & checkAttachmentFile
+	AttachmentTypes      []string
+	AttachmentExtensions []string
+	AttachmentInclude    []string
+	AttachmentExclude    []string
+	AttachmentMinSize    int
+	AttachmentMaxSize    int
+
+	// storage keys of the attachments, see renderKey & resolveKeyCollision
+	KeyTemplate  string
+	KeyCollision string
+
+	// archiving of the message itself, see archiveMessage
+	StoreEml      bool
+	StoreBody     string
+	StoreMetadata bool
+
+	Bucket      string
+	ApiEndpoint string
+
+	ShutdownTimeout time.Duration
+}
+
+// ParseEmailConfig validates the "email" source config. Empty values use the defaults.
+func ParseEmailConfig(config map[string]string) (EmailConfig, error) {
+	p := newConfigParser(config)
+	emailConfig := EmailConfig{
+		ImapHostname: p.Required("imap-hostname"),
+		ImapPort:     p.Int("imap-port", 993, 1),
+		ImapUsername: p.Required("imap-username"),
+		ImapPassword: p.Required("imap-password"),
+		ImapFolder:   p.String("imap-folder", "INBOX"),
+		ImapInterval: p.Seconds("imap-interval", 600, 1),
+		ImapIdle:     p.Bool("imap-idle", true),
+
+		PostProcess:     p.OneOf("post-process", "delete", "delete", "move", "flag"),
+		ProcessedFolder: p.String("processed-folder", "Processed"),
+		ProcessedFlag:   p.String("processed-flag", "$LodestoneProcessed"),
+		OnFailure:       p.OneOf("on-failure", "move", "move", "keep"),
+		FailedFolder:    p.String("failed-folder", "Failed"),
+
+		AllowSenders: p.List("allow-senders"),
+		DenySenders:  p.List("deny-senders"),
+		RequireSpf:   p.Bool("require-spf", false),
+		RequireDkim:  p.Bool("require-dkim", false),
+		AuthservId:   p.String("authserv-id", ""),
+
+		AttachmentTypes:      p.ListOr("attachment-types", defaultAttachmentTypes),
+		AttachmentExtensions: p.ListOr("attachment-extensions", defaultAttachmentExtensions),
+		AttachmentInclude:    p.List("attachment-include"),
+		AttachmentExclude:    p.List("attachment-exclude"),
+		AttachmentMinSize:    p.Int("attachment-min-size", defaultAttachmentMinSize, 0),
+		AttachmentMaxSize:    p.Int("attachment-max-size", defaultAttachmentMaxSize, 0),
+
+		KeyTemplate:  p.String("key-template", defaultKeyTemplate),
+		KeyCollision: p.OneOf("key-collision", "skip-identical", "skip-identical", "suffix", "hash", "overwrite"),
+
+		StoreEml:      p.Bool("store-eml", false),
+		StoreBody:     p.OneOf("store-body", "none", "none", "text", "html", "both"),
+		StoreMetadata: p.Bool("store-metadata", false),
+
+		Bucket:      p.Required("bucket"),
+		ApiEndpoint: p.String("api-endpoint", "http://webapp:3000"),
+
+		ShutdownTimeout: p.Seconds("shutdown-timeout", 30, 0),
+	}
+	if err := validateKeyTemplate(emailConfig.KeyTemplate); err != nil {
+		p.fail("key-template", err.Error())
+	}
+	// moving messages to the watched folder would process them again
+	if emailConfig.PostProcess == "move" && strings.EqualFold(emailConfig.ProcessedFolder, emailConfig.ImapFolder) {
+		p.fail("processed-folder", "must not be the watched folder (imap-folder)")
+	}
+	if emailConfig.OnFailure == "move" && strings.EqualFold(emailConfig.FailedFolder, emailConfig.ImapFolder) {
+		p.fail("failed-folder", "must not be the watched folder (imap-folder)")
+	}
+	return emailConfig, p.Err()
+}
+
+// configParser reads typed values from a source config, recording the first invalid key. Keys that are never read
+// are reported as unknown by Err, so that typos are not silently ignored.
+type configParser struct {
+	config map[string]string
+	known  map[string]bool
+	err    error
+}
+
+func newConfigParser(config map[string]string) *configParser {
+	return &configParser{config: config, known: map[string]bool{}}
+}
+
+func (p *configParser) fail(key string, reason string) {
+	if p.err == nil {
+		p.err = &ConfigError{Key: key, Reason: reason}
+	}
+}
+
+func (p *configParser) String(key string, defaultValue string) string {
+	p.known[key] = true
+	if value := strings.TrimSpace(p.config[key]); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (p *configParser) Required(key string) string {
+	value := p.String(key, "")
+	if value == "" {
+		p.fail(key, "is required")
+	}
+	return value
+}
+
+func (p *configParser) Int(key string, defaultValue int, min int) int {
+	value := p.String(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		p.fail(key, fmt.Sprintf("%q is not a number", value))
+		return defaultValue
+	}
+	if number < min {
+		p.fail(key, fmt.Sprintf("must be at least %d", min))
+		return defaultValue
+	}
+	return number
+}
+
+func (p *configParser) Seconds(key string, defaultValue int, min int) time.Duration {
+	return time.Duration(p.Int(key, defaultValue, min)) * time.Second
+}
+
+func (p *configParser) Bool(key string, defaultValue bool) bool {
+	value := p.String(key, "")
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(key, fmt.Sprintf("%q is not true or false", value))
+		return defaultValue
+	}
+	return b
+}
+
+func (p *configParser) OneOf(key string, defaultValue string, values ...string) string {
+	value := p.String(key, defaultValue)
+	for _, allowed := range values {
+		if value == allowed {
+			return value
+		}
+	}
+	p.fail(key, fmt.Sprintf("%q must be one of %v", value, strings.Join(values, ", ")))
+	return defaultValue
+}
+
+// List reads a comma separated value, skipping empty entries
+func (p *configParser) List(key string) []string {
+	return splitList(p.String(key, ""))
+}
+
+// ListOr reads a comma separated value, or returns the default list if the value is empty
+func (p *configParser) ListOr(key string, defaultValue []string) []string {
+	if list := p.List(key); len(list) > 0 {
+		return list
+	}
+	return defaultValue
+}
+
+// Err returns the first invalid key, or any unknown key in the config
+func (p *configParser) Err() error {
+	if p.err != nil {
+		return p.err
+	}
+	unknown := []string{}
+	for key := range p.config {
+		if !p.known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &ConfigError{Key: unknown[0], Reason: "unknown key"}
+	}
+	return nil
+}
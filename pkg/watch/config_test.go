@@ -0,0 +1,154 @@
+package watch
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFsConfigDefaults(t *testing.T) {
+	fsConfig, err := ParseFsConfig(map[string]string{"dir": "/data", "bucket": "documents", "workers": " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FsConfig{
+		Dir:             "/data",
+		Bucket:          "documents",
+		Source:          "fs",
+		Include:         []string{},
+		Exclude:         []string{},
+		WatchMode:       "auto",
+		PollInterval:    60 * time.Second,
+		Workers:         4,
+		QueueSize:       100,
+		ApiEndpoint:     "http://webapp:3000",
+		ShutdownTimeout: 30 * time.Second,
+	}
+	if !reflect.DeepEqual(fsConfig, want) {
+		t.Errorf("ParseFsConfig() = %+v, want %+v", fsConfig, want)
+	}
+}
+
+func TestParseFsConfig(t *testing.T) {
+	fsConfig, err := ParseFsConfig(map[string]string{
+		"dir":           "/data",
+		"bucket":        "documents",
+		"include":       "*.pdf, ,*.tif,",
+		"watch-mode":    "poll",
+		"poll-interval": "5",
+		"queue-size":    "0",
+		"mirror":        "TRUE",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fsConfig.Include, []string{"*.pdf", "*.tif"}) {
+		t.Errorf("Include = %q", fsConfig.Include)
+	}
+	if fsConfig.WatchMode != "poll" || fsConfig.PollInterval != 5*time.Second || fsConfig.QueueSize != 0 || !fsConfig.Mirror {
+		t.Errorf("ParseFsConfig() = %+v", fsConfig)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	fs := func(config map[string]string) error {
+		config["dir"] = "/data"
+		config["bucket"] = "documents"
+		_, err := ParseFsConfig(config)
+		return err
+	}
+	email := func(config map[string]string) error {
+		config["imap-hostname"] = "imap.example.com"
+		config["imap-username"] = "documents"
+		config["imap-password"] = "secret"
+		config["bucket"] = "documents"
+		_, err := ParseEmailConfig(config)
+		return err
+	}
+
+	tests := []struct {
+		name   string
+		parse  func(map[string]string) error
+		config map[string]string
+		want   string
+	}{
+		{"required", func(config map[string]string) error {
+			_, err := ParseFsConfig(config)
+			return err
+		}, map[string]string{"bucket": "documents"}, `invalid config "dir": is required`},
+		{"not a number", fs, map[string]string{"workers": "four"}, `invalid config "workers": "four" is not a number`},
+		{"below minimum", fs, map[string]string{"workers": "0"}, `invalid config "workers": must be at least 1`},
+		{"seconds below minimum", fs, map[string]string{"poll-interval": "0"}, `invalid config "poll-interval": must be at least 1`},
+		{"not a bool", fs, map[string]string{"mirror": "yes"}, `invalid config "mirror": "yes" is not true or false`},
+		{"not one of", fs, map[string]string{"watch-mode": "fanotify"}, `invalid config "watch-mode": "fanotify" must be one of auto, inotify, poll`},
+		{"unknown key", fs, map[string]string{"exclde": "*.tmp", "a-typo": "x"}, `invalid config "a-typo": unknown key`},
+		{"first invalid key wins", fs, map[string]string{"workers": "0", "mirror": "yes"}, `invalid config "workers": must be at least 1`},
+		{"invalid before unknown", fs, map[string]string{"a-typo": "x", "mirror": "yes"}, `invalid config "mirror": "yes" is not true or false`},
+
+		{"email required", func(config map[string]string) error {
+			_, err := ParseEmailConfig(config)
+			return err
+		}, map[string]string{}, `invalid config "imap-hostname": is required`},
+		{"key template", email, map[string]string{"key-template": "{date}/{name}"}, `invalid config "key-template": unknown placeholder {name}`},
+		{"key collision", email, map[string]string{"key-collision": "rename"}, `invalid config "key-collision": "rename" must be one of skip-identical, suffix, hash, overwrite`},
+		{"processed folder", email, map[string]string{"post-process": "move", "processed-folder": "inbox"}, `invalid config "processed-folder": must not be the watched folder (imap-folder)`},
+		{"failed folder", email, map[string]string{"imap-folder": "Scans", "failed-folder": "Scans"}, `invalid config "failed-folder": must not be the watched folder (imap-folder)`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.parse(test.config)
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("error = %v, want a ConfigError", err)
+			}
+			if err.Error() != test.want {
+				t.Errorf("error = %q, want %q", err.Error(), test.want)
+			}
+		})
+	}
+}
+
+func TestParseEmailConfigDefaults(t *testing.T) {
+	emailConfig, err := ParseEmailConfig(map[string]string{
+		"imap-hostname": "imap.example.com",
+		"imap-username": "documents",
+		"imap-password": "secret",
+		"bucket":        "documents",
+		"post-process":  "move",
+		"on-failure":    "keep",
+		// the processed folder only has to differ from the watched folder when messages are moved there
+		"imap-folder":      "Scans",
+		"processed-folder": "Processed",
+		"failed-folder":    "Scans",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emailConfig.ImapPort != 993 || emailConfig.ImapInterval != 10*time.Minute || !emailConfig.ImapIdle {
+		t.Errorf("imap defaults = %+v", emailConfig)
+	}
+	if !reflect.DeepEqual(emailConfig.AttachmentTypes, defaultAttachmentTypes) || !reflect.DeepEqual(emailConfig.AttachmentExtensions, defaultAttachmentExtensions) {
+		t.Errorf("attachment defaults = %v, %v", emailConfig.AttachmentTypes, emailConfig.AttachmentExtensions)
+	}
+	if emailConfig.KeyTemplate != defaultKeyTemplate || emailConfig.KeyCollision != "skip-identical" || emailConfig.StoreBody != "none" {
+		t.Errorf("storage defaults = %+v", emailConfig)
+	}
+}
+
+func TestConfigParserListOr(t *testing.T) {
+	defaults := []string{"pdf"}
+	p := newConfigParser(map[string]string{"empty": " , ", "set": "png,jpg"})
+	if got := p.ListOr("missing", defaults); !reflect.DeepEqual(got, defaults) {
+		t.Errorf("ListOr(missing) = %v", got)
+	}
+	if got := p.ListOr("empty", defaults); !reflect.DeepEqual(got, defaults) {
+		t.Errorf("ListOr(empty) = %v", got)
+	}
+	if got := p.ListOr("set", defaults); !reflect.DeepEqual(got, []string{"png", "jpg"}) {
+		t.Errorf("ListOr(set) = %v", got)
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+}
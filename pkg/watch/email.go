@@ -1,151 +1,373 @@
 package watch
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
+	"github.com/analogj/lodestone-publisher/pkg/model"
 	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"github.com/analogj/lodestone-publisher/pkg/storage"
+	"github.com/analogj/lodestone-publisher/pkg/tracing"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-message/mail"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	// How long a batch of messages may take to process, before the source is considered stuck
+	emailLivenessGrace = 10 * time.Minute
+
+	// Servers may log out clients that idle for 30 minutes (RFC 2177), so IDLE is re-issued before that
+	imapIdleRestart = 25 * time.Minute
+)
+
+func init() {
+	Register("email", func() Interface { return new(EmailWatcher) })
+}
+
 type EmailWatcher struct {
-	logger       *logrus.Entry
-	apiEndpoint  string
-	bucket       string
-	imapInterval int
+	statusTracker
+
+	logger        *logrus.Entry
+	configMutex   sync.RWMutex
+	config        EmailConfig
+	storageClient *storage.Client
+
+	// the imap session, reported by Ready
+	sessionMutex sync.Mutex
+	client       *client.Client
+	sessionErr   error
+
+	// UIDs of the messages marked as deleted, but not expunged yet (see deleteMessages). Only used by the batch loop.
+	unexpunged *imap.SeqSet
+}
+
+// Validate checks the config, see ParseEmailConfig
+func (ew *EmailWatcher) Validate(config map[string]string) error {
+	_, err := ParseEmailConfig(config)
+	return err
 }
 
-func (ew *EmailWatcher) Start(logger *logrus.Entry, notifyClient notify.Interface, config map[string]string) {
+// Reload swaps the config used by the next batch of messages. Changing the server, credentials, folder or api endpoint
+// requires a restart.
+func (ew *EmailWatcher) Reload(config map[string]string) error {
+	emailConfig, err := ParseEmailConfig(config)
+	if err != nil {
+		return err
+	}
+
+	ew.configMutex.Lock()
+	defer ew.configMutex.Unlock()
+	if emailConfig.ImapHostname != ew.config.ImapHostname || emailConfig.ImapPort != ew.config.ImapPort ||
+		emailConfig.ImapUsername != ew.config.ImapUsername || emailConfig.ImapPassword != ew.config.ImapPassword ||
+		emailConfig.ImapFolder != ew.config.ImapFolder || emailConfig.ApiEndpoint != ew.config.ApiEndpoint {
+		return ErrRestartRequired
+	}
+	ew.config = emailConfig
+	ew.setLivenessTimeout(emailConfig.ImapInterval + emailLivenessGrace)
+	return nil
+}
+
+// Ready checks that the imap session is logged in, that the last mailbox selection succeeded, and that the storage api
+// is reachable.
+func (ew *EmailWatcher) Ready() error {
+	ew.sessionMutex.Lock()
+	c, sessionErr := ew.client, ew.sessionErr
+	ew.sessionMutex.Unlock()
+	if sessionErr != nil {
+		return fmt.Errorf("imap session unavailable: %v", sessionErr)
+	}
+	if c == nil {
+		return errors.New("not connected to the imap server")
+	}
+	select {
+	case <-c.LoggedOut():
+		return errors.New("imap session lost")
+	default:
+	}
+
+	if err := ew.storageClient.Ping(); err != nil {
+		return fmt.Errorf("storage api unavailable: %v", err)
+	}
+	return nil
+}
+
+// setSession records the imap client (nil when disconnected) and the last login or select error
+func (ew *EmailWatcher) setSession(c *client.Client, err error) {
+	ew.sessionMutex.Lock()
+	defer ew.sessionMutex.Unlock()
+	ew.client = c
+	ew.sessionErr = err
+}
+
+func (ew *EmailWatcher) currentConfig() EmailConfig {
+	ew.configMutex.RLock()
+	defer ew.configMutex.RUnlock()
+	return ew.config
+}
+
+// Start processes the mailbox whenever the server reports new messages (IMAP IDLE), or every "imap-interval" seconds if
+// the server doesn't support IDLE, blocking until the context is cancelled. On shutdown, the batch of messages
+// currently being processed is given "shutdown-timeout" seconds to complete.
+func (ew *EmailWatcher) Start(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface, config map[string]string) error {
 	ew.logger = logger
-	ew.apiEndpoint = config["api-endpoint"]
-	ew.bucket = config["bucket"]
-	interval, err := strconv.Atoi(config["imap-interval"])
+	ew.setState(StateStarting, nil)
+	emailConfig, err := ParseEmailConfig(config)
 	if err != nil {
-		//use a sane default for interval
-		ew.imapInterval = 600
-	} else {
-		ew.imapInterval = interval
+		return err
 	}
+	ew.configMutex.Lock()
+	ew.config = emailConfig
+	ew.configMutex.Unlock()
+	ew.storageClient = storage.NewClient(emailConfig.ApiEndpoint)
+	ew.setSession(nil, nil)
+	ew.unexpunged = new(imap.SeqSet)
+	// the last error is still reported once the session ended
+	defer func() {
+		ew.sessionMutex.Lock()
+		defer ew.sessionMutex.Unlock()
+		ew.client = nil
+	}()
 
 	ew.logger.Infoln("Connecting to server...")
 
 	// Connect to server
-	c, err := client.DialTLS(fmt.Sprintf("%s:%s", config["imap-hostname"], config["imap-port"]), &tls.Config{ServerName: config["imap-hostname"]})
+	c, err := client.DialTLS(fmt.Sprintf("%s:%d", emailConfig.ImapHostname, emailConfig.ImapPort), &tls.Config{ServerName: emailConfig.ImapHostname})
 	if err != nil {
-		ew.logger.Fatal(err)
+		ew.setSession(nil, fmt.Errorf("failed to connect: %v", err))
+		return err
 	}
 	ew.logger.Infoln("Connected")
 
 	// Don't forget to logout
 	defer c.Logout()
 
+	// unsolicited updates (eg. new messages while idling) must be consumed from before logging in, or the client
+	// blocks. The channel is unbuffered, so updates for a command are consumed before the command returns.
+	updates := make(chan client.Update)
+	c.Updates = updates
+	mailboxChanged := make(chan bool, 1)
+	go consumeUpdates(updates, c.LoggedOut(), mailboxChanged)
+
 	// Login
-	if err := c.Login(config["imap-username"], config["imap-password"]); err != nil {
-		ew.logger.Fatal(err)
+	if err := c.Login(emailConfig.ImapUsername, emailConfig.ImapPassword); err != nil {
+		ew.setSession(nil, fmt.Errorf("failed to log in: %v", err))
+		return err
 	}
 	ew.logger.Println("Logged in")
+	ew.setSession(c, nil)
+	ew.setLivenessTimeout(emailConfig.ImapInterval + emailLivenessGrace)
+	ew.setState(StateRunning, nil)
+
+	// stop the loop if the imap session is lost
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the messages being processed are not aborted on shutdown, unless the shutdown timeout expires
+	workCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			//loop until shutdown.
+			// process messages, wait for x seconds (imap-interval), then start processing again.
+			ew.batchProcessMessages(ctx, workCtx, c, notifyClient)
+			ew.touch()
+			if ctx.Err() != nil {
+				return
+			}
+			ew.waitForMessages(ctx, c, mailboxChanged)
+		}
+	}()
 
-	for {
-		//loop forever.
-		// process messages, wait for x seconds (imap-interval), then start processing again.
-		ew.batchProcessMessages(c)
-
-		ew.logger.Printf("Sleeping for %d seconds...", ew.imapInterval)
-		time.Sleep(time.Duration(ew.imapInterval) * time.Second)
-
+	var sessionErr error
+	select {
+	case <-ctx.Done():
+		ew.logger.Infoln("Waiting for in-flight messages to be processed")
+	case <-c.LoggedOut():
+		sessionErr = errors.New("imap session lost")
+		cancel()
 	}
-
+	ew.setState(StateStopping, nil)
+	select {
+	case <-stopped:
+	case <-time.After(ew.currentConfig().ShutdownTimeout):
+		// the connection is still in use, so it is closed (failing any pending command) and the in-flight uploads &
+		// publishes are aborted. The client must not be used (or logged out) until the loop returned.
+		ew.logger.Warnln("Shutdown timeout expired, abandoning in-flight messages")
+		abort()
+		c.Terminate()
+		<-stopped
+	}
+	ew.setState(StateStopped, nil)
+	return sessionErr
 }
 
-func (ew *EmailWatcher) batchProcessMessages(c *client.Client) {
+// batchProcessMessages processes the messages in the mailbox. Each message is handled separately: it is only deleted,
+// moved or flagged ("post-process") once all its attachments were uploaded, and their events confirmed. Errors are
+// logged, and the remaining messages are processed by the next check.
+// No new batch is started once ctx is cancelled, the messages of the current batch are processed with workCtx.
+func (ew *EmailWatcher) batchProcessMessages(ctx context.Context, workCtx context.Context, c *client.Client, notifyClient notify.Interface) {
 	//retrieve messages from mailbox
 	//note: the number of messages may be absurdly large, so lets do this in batches for safety (sets of 100 messages)
 
-	//retrieve 100 messages at a time, after processing we will delete them
+	// messages are identified by UID, so that moving or deleting messages doesn't change the ids of the others
 
-	// message ranges are 1 base indexed.
-	// ie, batches include messages from 1-100
+	// failed messages that are left in the mailbox are retried by the next check, not by the next batch
+	skipped := new(imap.SeqSet)
 
-	for {
+	// stop starting new batches on shutdown
+	for ctx.Err() == nil {
 		// get lastest mailbox information
-		mbox, err := c.Select("INBOX", false)
-		if err != nil {
-			ew.logger.Fatal(err)
+		if _, err := c.Select(ew.currentConfig().ImapFolder, false); err != nil {
+			ew.logger.Errorf("Failed to select the mailbox, retrying later: %v", err)
+			ew.setSession(c, fmt.Errorf("failed to select %v: %v", ew.currentConfig().ImapFolder, err))
+			return
 		}
-		// Get all messages
-		if mbox.Messages == 0 {
-			//if theres no messages to process, break out of the loop and wait for next imap interval
-			ew.logger.Printf("No messages to process")
-			break
+		ew.setSession(c, nil)
+
+		// flagged messages were already processed, and are left in the mailbox. Deleted messages (by us, or by
+		// another client) are left for EXPUNGE.
+		criteria := imap.NewSearchCriteria()
+		criteria.WithoutFlags = []string{imap.DeletedFlag}
+		if emailConfig := ew.currentConfig(); emailConfig.PostProcess == "flag" {
+			criteria.WithoutFlags = append(criteria.WithoutFlags, emailConfig.ProcessedFlag)
 		}
-
-		from := uint32(1)
-		to := uint32(100)
-		if mbox.Messages < to {
-			to = mbox.Messages
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			ew.logger.Errorf("Failed to search the mailbox, retrying later: %v", err)
+			return
 		}
 
+		//retrieve 100 messages at a time
 		seqset := new(imap.SeqSet)
-		seqset.AddRange(from, to)
+		count := 0
+		for _, uid := range uids {
+			if !skipped.Contains(uid) && count < 100 {
+				seqset.AddNum(uid)
+				count++
+			}
+		}
+		if count == 0 {
+			//if theres no messages to process, break out of the loop and wait for next imap interval
+			ew.logger.Printf("No messages to process")
+			return
+		}
 
 		ew.logger.Printf("Retrieving messages")
-		ew.retrieveMessages(c, seqset)
-
-		//todo publish/generate events for stored documents
-		ew.generateEvent()
-
-		//delete messages
-		ew.deleteMessages(c, seqset)
+		// each batch is traced separately
+		fetchCtx, span := tracing.Tracer().Start(workCtx, "imap.fetch", trace.WithAttributes(
+			attribute.String("imap.account", ew.currentConfig().ImapUsername),
+			attribute.String("imap.mailbox", ew.currentConfig().ImapFolder),
+			attribute.String("imap.seqset", seqset.String()),
+		))
+		processed, failed, err := ew.retrieveMessages(fetchCtx, c, seqset, notifyClient)
+		tracing.End(span, err)
+
+		// messages that were processed before the fetch failed are still post-processed
+		if err := ew.postProcessMessages(c, processed, failed); err != nil {
+			// the messages are processed again by the next check
+			ew.logger.Errorf("Failed to post-process messages, retrying later: %v", err)
+			return
+		}
+		if err != nil {
+			ew.logger.Errorf("Failed to fetch messages, retrying later: %v", err)
+			return
+		}
+		if ew.currentConfig().OnFailure == "keep" {
+			skipped.AddSet(failed)
+		}
 	}
-
 }
 
-func (ew *EmailWatcher) retrieveMessages(c *client.Client, seqset *imap.SeqSet) {
-	// Get the whole message body
-	section := &imap.BodySectionName{}
+// retrieveMessages processes the messages (by UID), returning the UIDs of the messages that were processed, and of
+// the messages that failed. If the fetch fails, the messages processed so far are returned with the error.
+func (ew *EmailWatcher) retrieveMessages(ctx context.Context, c *client.Client, seqset *imap.SeqSet, notifyClient notify.Interface) (processed *imap.SeqSet, failed *imap.SeqSet, err error) {
+	// Get the whole message body. BODY.PEEK[] does not set \Seen on the fetched messages, so that \Seen can be used as
+	// the "processed-flag", and failed messages that are kept are retried.
+	section := &imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{section.FetchItem(), imap.FetchUid}
 
 	messages := make(chan *imap.Message, 1)
 	done := make(chan error, 1)
 	go func() {
-		done <- c.Fetch(seqset, items, messages)
+		done <- c.UidFetch(seqset, items, messages)
 	}()
 
+	processed = new(imap.SeqSet)
+	failed = new(imap.SeqSet)
 	for msg := range messages {
 		ew.logger.Debugln("UID: ", msg.Uid)
+		ew.touch()
+		metrics.ImapMessagesFetched.WithLabelValues(ew.currentConfig().ImapUsername, ew.currentConfig().ImapFolder).Inc()
 		/* read and process the email */
 
-		ew.storeAttachments(c, section, msg)
+		msgCtx, span := tracing.Tracer().Start(ctx, "email.message", trace.WithAttributes(attribute.Int64("imap.uid", int64(msg.Uid))))
+		err := ew.processMessage(msgCtx, c, section, msg, notifyClient)
+		tracing.End(span, err)
+		if err != nil {
+			ew.logger.Errorf("Failed to process message %v: %v", msg.Uid, err)
+			failed.AddNum(msg.Uid)
+		} else {
+			processed.AddNum(msg.Uid)
+		}
+	}
+
+	return processed, failed, <-done
+}
 
+// processMessage uploads the attachments of the message (and the message itself, see archiveMessage), then publishes
+// an event for each uploaded object
+func (ew *EmailWatcher) processMessage(ctx context.Context, c *client.Client, section *imap.BodySectionName, msg *imap.Message, notifyClient notify.Interface) error {
+	//make a temporary directory for subsequent processing (attachment file download)
+	//the local copies are kept until the events are published, they are used to compute the size & ETag
+	localTempDir, err := ioutil.TempDir("", "attach")
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(localTempDir) // clean up
 
-	if err := <-done; err != nil {
-		ew.logger.Fatal(err)
+	objects, err := ew.storeMessage(ctx, c, section, msg, localTempDir)
+	if err != nil {
+		return err
 	}
+	return ew.generateEvents(ctx, notifyClient, objects)
 }
 
-func (ew *EmailWatcher) storeAttachments(c *client.Client, section *imap.BodySectionName, msg *imap.Message) ([]string, error) {
+// storedObject is an attachment (or an archived part of the message) that was uploaded to the storage api
+type storedObject struct {
+	storagePath string
+	localPath   string
+}
+
+func (ew *EmailWatcher) storeMessage(ctx context.Context, c *client.Client, section *imap.BodySectionName, msg *imap.Message, localTempDir string) ([]storedObject, error) {
 	r := msg.GetBody(section)
 	if r == nil {
-		ew.logger.Warnln("Error: Message body empty.")
-		return nil, nil
+		return nil, errors.New("message body is empty")
+	}
+	// the raw message is needed to verify DKIM signatures, and to archive the message
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create a new mail reader
-	mr, err := mail.CreateReader(r)
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
 	if err != nil {
-		ew.logger.Errorf("Error creating mail readerr: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("error creating mail reader: %v", err)
 	}
 
 	// Print some info about the message
@@ -163,48 +385,123 @@ func (ew *EmailWatcher) storeAttachments(c *client.Client, section *imap.BodySec
 		ew.logger.Debugln("Subject:", subject)
 	}
 
-	//TODO: filter message based on sender, attachment type
+	// reject messages from unknown senders before storing anything
+	if rejected := ew.checkSender(ew.currentConfig(), raw, header); rejected != nil {
+		metrics.MessagesRejected.WithLabelValues(ew.currentConfig().ImapUsername, ew.currentConfig().ImapFolder, rejected.Check).Inc()
+		return nil, rejected
+	}
 
-	//make a temporary directory for subsequent processing (attachment file download)
-	localTempDir, err := ioutil.TempDir("", "attach")
-	if err != nil {
-		return nil, err
+	// the values of the key template placeholders that are the same for every attachment
+	fields := keyFields{Date: time.Now(), Uid: msg.Uid, Mailbox: ew.currentConfig().ImapFolder, MessageId: header.Get("Message-Id")}
+	if date, err := header.Date(); err == nil && !date.IsZero() {
+		fields.Date = date
+	}
+	fields.Date = fields.Date.UTC()
+	if from, err := header.AddressList("From"); err == nil && len(from) > 0 {
+		fields.Sender = from[0].Address
+	}
+	if fields.MessageId == "" {
+		// still stable when the message is processed again
+		fields.MessageId = string(raw)
 	}
-	defer os.RemoveAll(localTempDir) // clean up
 
-	storagePaths := []string{}
-	for {
+	// every attachment must be stored (unless skipped by the attachment rules), otherwise the message fails (and is kept)
+	emailConfig := ew.currentConfig()
+	attachments := []storedObject{}
+	bodies := map[string]string{}
+	for index := 0; ; index++ {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			ew.logger.Fatal(err)
+			return nil, fmt.Errorf("error reading message part: %v", err)
 		}
 		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			// the first text & html parts are the body of the message
+			if filename := bodyFilename(emailConfig, h); filename != "" && bodies[filename] == "" {
+				localPath, err := ew.saveAttachment(ctx, filename, index, p.Body, localTempDir)
+				if err != nil {
+					return nil, fmt.Errorf("error saving the message body: %v", err)
+				}
+				bodies[filename] = localPath
+			}
 		case *mail.AttachmentHeader:
 			// This is an attachment
-			attachmentFilename, _ := h.Filename()
+			attachmentFilename := attachmentFilename(h, index)
+			if skipped := checkAttachmentName(emailConfig, attachmentFilename); skipped != nil {
+				ew.skipAttachment(attachmentFilename, skipped)
+				continue
+			}
 
-			localPath, err := ew.saveAttachment(attachmentFilename, p.Body, localTempDir)
+			// stop reading oversized attachments as soon as they exceed the maximum size
+			body := p.Body
+			if emailConfig.AttachmentMaxSize > 0 {
+				body = io.LimitReader(p.Body, int64(emailConfig.AttachmentMaxSize)+1)
+			}
+			localPath, err := ew.saveAttachment(ctx, attachmentFilename, index, body, localTempDir)
 			if err != nil {
+				return nil, fmt.Errorf("error saving attachment %v: %v", attachmentFilename, err)
+			}
+			if skipped := checkAttachmentFile(emailConfig, localPath); skipped != nil {
+				if contentType, _, err := h.ContentType(); err == nil {
+					ew.logger.Debugf("Declared content type of %v: %v", attachmentFilename, contentType)
+				}
+				ew.skipAttachment(attachmentFilename, skipped)
+				os.Remove(localPath)
 				continue
 			}
-			storagePath := filepath.Join("email", attachmentFilename)
-			err = ew.uploadAttachmentToStorage(storagePath, localPath)
+
+			fields.Index = index
+			fields.Filename = attachmentFilename
+			attachment, uploaded, err := ew.storeObject(ctx, emailConfig, fields, localPath)
 			if err != nil {
-				continue
+				return nil, fmt.Errorf("error storing attachment %v: %v", attachmentFilename, err)
+			}
+			if uploaded {
+				metrics.AttachmentsUploaded.WithLabelValues(emailConfig.ImapUsername, emailConfig.ImapFolder).Inc()
 			}
-			storagePaths = append(storagePaths, storagePath)
+			attachments = append(attachments, attachment)
 		}
 	}
 
-	return storagePaths, nil
+	archived, err := ew.archiveMessage(ctx, emailConfig, fields, header, raw, bodies, attachments, localTempDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(attachments, archived...), nil
+}
+
+// storeObject uploads the local file to the key rendered from the "key-template", applying the "key-collision"
+// strategy. Returns false if the identical object was already stored, and the upload was skipped.
+func (ew *EmailWatcher) storeObject(ctx context.Context, emailConfig EmailConfig, fields keyFields, localPath string) (storedObject, bool, error) {
+	storagePath, identical, err := ew.resolveKeyCollision(ctx, emailConfig, renderKey(emailConfig.KeyTemplate, fields), localPath)
+	if err != nil {
+		return storedObject{}, false, fmt.Errorf("error choosing a key: %v", err)
+	}
+	object := storedObject{storagePath: storagePath, localPath: localPath}
+	if identical {
+		// the event is still published, in case the previous attempt failed to publish it
+		ew.logger.Infof("%v is already stored, skipping the upload", storagePath)
+		return object, false, nil
+	}
+	if err := ew.uploadAttachmentToStorage(ctx, storagePath, localPath); err != nil {
+		return storedObject{}, false, err
+	}
+	return object, true, nil
 }
 
-func (ew *EmailWatcher) saveAttachment(attachmentFilename string, attachmentData io.Reader, localTempDir string) (string, error) {
+func (ew *EmailWatcher) skipAttachment(attachmentFilename string, skipped *SkippedError) {
+	ew.logger.Infof("Skipping attachment %v: %v", attachmentFilename, skipped.Reason)
+	metrics.AttachmentsSkipped.WithLabelValues(ew.currentConfig().ImapUsername, ew.currentConfig().ImapFolder, skipped.Rule).Inc()
+}
 
-	fileName := filepath.Base(attachmentFilename)
-	localFilepath := filepath.Join(localTempDir, fileName)
+// saveAttachment writes the attachment to the temporary directory. The index keeps attachments with the same name apart.
+func (ew *EmailWatcher) saveAttachment(ctx context.Context, attachmentFilename string, index int, attachmentData io.Reader, localTempDir string) (localFilepath string, err error) {
+	_, span := tracing.Tracer().Start(ctx, "email.save_attachment", trace.WithAttributes(attribute.String("email.attachment", attachmentFilename)))
+	defer func() { tracing.End(span, err) }()
+
+	localFilepath = filepath.Join(localTempDir, fmt.Sprintf("%d-%s", index, keyFilename(keyFields{Filename: attachmentFilename, Index: index})))
 	ew.logger.Infof("Store attachment locally: %v, %v", attachmentFilename, localFilepath)
 
 	localFile, err := os.Create(localFilepath)
@@ -213,52 +510,159 @@ func (ew *EmailWatcher) saveAttachment(attachmentFilename string, attachmentData
 	}
 	defer localFile.Close()
 
-	_, err = io.Copy(localFile, attachmentData)
+	written, err := io.Copy(localFile, attachmentData)
 	if err != nil {
 		return "", err
 	}
+	span.SetAttributes(attribute.Int64("email.attachment.size", written))
 
 	return localFilepath, err
 }
 
-func (ew *EmailWatcher) uploadAttachmentToStorage(storagePath string, localFilepath string) error {
+func (ew *EmailWatcher) uploadAttachmentToStorage(ctx context.Context, storagePath string, localFilepath string) error {
+	return ew.storageClient.Upload(ctx, ew.currentConfig().Bucket, storagePath, localFilepath)
+}
 
-	localFile, err := os.Open(localFilepath)
-	if err != nil {
-		return err
-	}
-	defer localFile.Close()
+// generateEvents publishes an s3:ObjectCreated:Put event for each uploaded object. Every event is attempted,
+// the first error is returned.
+func (ew *EmailWatcher) generateEvents(ctx context.Context, notifyClient notify.Interface, objects []storedObject) error {
+	s3EventName := "s3:ObjectCreated:Put"
+	bucket := ew.currentConfig().Bucket
 
-	//manipulate the path
-	apiEndpoint, err := url.Parse(ew.apiEndpoint)
-	if err != nil {
-		return err
+	var firstErr error
+	for _, object := range objects {
+		metrics.EventsSeen.WithLabelValues("email", bucket, s3EventName).Inc()
+
+		s3Event := model.S3Event{}
+		err := s3Event.Create("email", s3EventName, bucket, object.storagePath, object.localPath)
+		if err == nil {
+			err = notifyClient.Publish(ctx, s3Event)
+		}
+		if err != nil {
+			ew.logger.Errorf("Failed to publish event for %v: %v", object.storagePath, err)
+			metrics.EventsFailed.WithLabelValues("email", bucket, s3EventName).Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		metrics.EventsPublished.WithLabelValues("email", bucket, s3EventName).Inc()
 	}
-	apiEndpoint.Path = fmt.Sprintf("/api/v1/storage/%s/%s", ew.bucket, storagePath)
+	return firstErr
+}
 
-	resp, err := http.Post(apiEndpoint.String(), "binary/octet-stream", localFile)
-	if err != nil {
-		return err
+// postProcessMessages deletes, moves (to the "processed-folder") or flags (with the "processed-flag") the processed
+// messages, depending on "post-process", then moves the failed messages to the "failed-folder" (unless "on-failure" is
+// "keep", which leaves them in the mailbox).
+func (ew *EmailWatcher) postProcessMessages(c *client.Client, processed *imap.SeqSet, failed *imap.SeqSet) error {
+	emailConfig := ew.currentConfig()
+	if !processed.Empty() {
+		var err error
+		switch emailConfig.PostProcess {
+		case "move":
+			ew.logger.Debugf("Moving processed messages to %v", emailConfig.ProcessedFolder)
+			err = ew.moveMessages(c, processed, emailConfig.ProcessedFolder)
+		case "flag":
+			ew.logger.Debugf("Flagging processed messages with %v", emailConfig.ProcessedFlag)
+			item := imap.FormatFlagsOp(imap.AddFlags, true)
+			err = c.UidStore(processed, item, []interface{}{emailConfig.ProcessedFlag}, nil)
+		default:
+			err = ew.deleteMessages(c, processed)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	defer resp.Body.Close()
 
+	if !failed.Empty() && emailConfig.OnFailure == "move" {
+		ew.logger.Warnf("Moving failed messages to %v", emailConfig.FailedFolder)
+		return ew.moveMessages(c, failed, emailConfig.FailedFolder)
+	}
 	return nil
 }
 
-func (ew *EmailWatcher) generateEvent() {
+// moveMessages moves the messages to the folder, which is created if necessary. Servers without MOVE support fall
+// back to COPY, then delete (see deleteMessages).
+func (ew *EmailWatcher) moveMessages(c *client.Client, uids *imap.SeqSet, folder string) error {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", folder, mailboxes)
+	}()
+	exists := false
+	for range mailboxes {
+		exists = true
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if !exists {
+		ew.logger.Infof("Creating folder: %v", folder)
+		if err := c.Create(folder); err != nil {
+			return err
+		}
+	}
 
+	// the MOVE fallback of the client expunges every deleted message in the mailbox
+	if supported, err := c.Support("MOVE"); err != nil {
+		return err
+	} else if supported {
+		return c.UidMove(uids, folder)
+	}
+	if err := c.UidCopy(uids, folder); err != nil {
+		return err
+	}
+	return ew.deleteMessages(c, uids)
 }
 
-func (ew *EmailWatcher) deleteMessages(c *client.Client, seqset *imap.SeqSet) {
+// deleteMessages deletes the messages. Only these messages are expunged if the server supports UID EXPUNGE (UIDPLUS).
+// Otherwise EXPUNGE would also remove any other message marked as deleted in the mailbox (eg. by another client), so
+// it is only sent once the deleted messages are all ours. Until then, our messages stay marked as deleted, and are
+// skipped by the next checks.
+func (ew *EmailWatcher) deleteMessages(c *client.Client, uids *imap.SeqSet) error {
 	// Mark the messages as deleted
 	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{imap.DeletedFlag}
-	if err := c.Store(seqset, item, flags, nil); err != nil {
-		ew.logger.Fatal(err)
+	if err := c.UidStore(uids, item, flags, nil); err != nil {
+		return err
 	}
 
-	// Then delete it
-	if err := c.Expunge(nil); err != nil {
-		ew.logger.Fatal(err)
+	// Then delete them
+	supported, err := c.Support("UIDPLUS")
+	if err != nil {
+		return err
 	}
+	if !supported {
+		ew.unexpunged.AddSet(uids)
+		deleted, err := c.UidSearch(&imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+		if err != nil {
+			return err
+		}
+		for _, uid := range deleted {
+			if !ew.unexpunged.Contains(uid) {
+				ew.logger.Warnf("Server does not support UIDPLUS, and message %v was deleted by another client: processed messages are expunged later", uid)
+				return nil
+			}
+		}
+		ew.logger.Debugln("Server does not support UIDPLUS, expunging every deleted message")
+		if err := c.Expunge(nil); err != nil {
+			return err
+		}
+		ew.unexpunged = new(imap.SeqSet)
+		return nil
+	}
+	status, err := c.Execute(&uidExpunge{uids: uids}, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// uidExpunge is the UID EXPUNGE command (RFC 4315), which only expunges the specified messages
+type uidExpunge struct {
+	uids *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), cmd.uids}}
 }
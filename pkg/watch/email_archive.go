@@ -0,0 +1,143 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// Filenames of the archived parts of the message, rendered as {filename} in the "key-template"
+const (
+	emlFilename      = "message.eml"
+	textBodyFilename = "body.txt"
+	htmlBodyFilename = "body.html"
+	metadataFilename = "metadata.json"
+)
+
+// emailMetadata is the JSON sidecar ("store-metadata") describing the message, and the objects stored for it
+type emailMetadata struct {
+	MessageId string         `json:"messageId"`
+	Date      *time.Time     `json:"date,omitempty"`
+	From      []emailAddress `json:"from"`
+	To        []emailAddress `json:"to"`
+	Cc        []emailAddress `json:"cc"`
+	Subject   string         `json:"subject"`
+	Mailbox   string         `json:"mailbox"`
+	Uid       uint32         `json:"uid"`
+
+	// storage keys, in the same bucket
+	Message     string   `json:"message,omitempty"`
+	Body        []string `json:"body"`
+	Attachments []string `json:"attachments"`
+}
+
+type emailAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+// bodyFilename returns the filename the inline part is stored as, if it is a text or html body that should be stored
+// ("store-body"), or an empty string.
+func bodyFilename(emailConfig EmailConfig, h *mail.InlineHeader) string {
+	contentType, _, err := h.ContentType()
+	if err != nil {
+		return ""
+	}
+	if contentType == "text/plain" && (emailConfig.StoreBody == "text" || emailConfig.StoreBody == "both") {
+		return textBodyFilename
+	}
+	if contentType == "text/html" && (emailConfig.StoreBody == "html" || emailConfig.StoreBody == "both") {
+		return htmlBodyFilename
+	}
+	return ""
+}
+
+// archiveMessage stores the body ("store-body"), the original message as .eml ("store-eml") and the JSON metadata
+// ("store-metadata"), so that messages without attachments (eg. e-receipts) can be processed as documents too. The
+// metadata is stored last, as it lists the keys of the other objects.
+func (ew *EmailWatcher) archiveMessage(ctx context.Context, emailConfig EmailConfig, fields keyFields, header mail.Header, raw []byte, bodies map[string]string, attachments []storedObject, localTempDir string) ([]storedObject, error) {
+	archived := []storedObject{}
+	metadata := emailMetadata{
+		MessageId:   header.Get("Message-Id"),
+		From:        headerAddresses(header, "From"),
+		To:          headerAddresses(header, "To"),
+		Cc:          headerAddresses(header, "Cc"),
+		Mailbox:     fields.Mailbox,
+		Uid:         fields.Uid,
+		Body:        []string{},
+		Attachments: []string{},
+	}
+	if date, err := header.Date(); err == nil && !date.IsZero() {
+		metadata.Date = &date
+	}
+	metadata.Subject, _ = header.Subject()
+	for _, attachment := range attachments {
+		metadata.Attachments = append(metadata.Attachments, attachment.storagePath)
+	}
+
+	// the archived parts are not attachments, so {index} is empty
+	fields.Index = -1
+	for _, filename := range []string{textBodyFilename, htmlBodyFilename} {
+		if localPath, ok := bodies[filename]; ok {
+			fields.Filename = filename
+			body, _, err := ew.storeObject(ctx, emailConfig, fields, localPath)
+			if err != nil {
+				return nil, fmt.Errorf("error storing the message body: %v", err)
+			}
+			metadata.Body = append(metadata.Body, body.storagePath)
+			archived = append(archived, body)
+		}
+	}
+
+	if emailConfig.StoreEml {
+		localPath := filepath.Join(localTempDir, emlFilename)
+		if err := ioutil.WriteFile(localPath, raw, 0600); err != nil {
+			return nil, err
+		}
+		fields.Filename = emlFilename
+		eml, _, err := ew.storeObject(ctx, emailConfig, fields, localPath)
+		if err != nil {
+			return nil, fmt.Errorf("error storing the message: %v", err)
+		}
+		metadata.Message = eml.storagePath
+		archived = append(archived, eml)
+	}
+
+	if emailConfig.StoreMetadata {
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		encoder.SetEscapeHTML(false) // keep <message-id> readable
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(metadata); err != nil {
+			return nil, err
+		}
+		localPath := filepath.Join(localTempDir, metadataFilename)
+		if err := ioutil.WriteFile(localPath, data.Bytes(), 0600); err != nil {
+			return nil, err
+		}
+		fields.Filename = metadataFilename
+		sidecar, _, err := ew.storeObject(ctx, emailConfig, fields, localPath)
+		if err != nil {
+			return nil, fmt.Errorf("error storing the message metadata: %v", err)
+		}
+		archived = append(archived, sidecar)
+	}
+	return archived, nil
+}
+
+func headerAddresses(header mail.Header, key string) []emailAddress {
+	addresses := []emailAddress{}
+	list, err := header.AddressList(key)
+	if err != nil {
+		return addresses
+	}
+	for _, address := range list {
+		addresses = append(addresses, emailAddress{Name: address.Name, Address: address.Address})
+	}
+	return addresses
+}
@@ -0,0 +1,203 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/analogj/lodestone-publisher/pkg/storage"
+	"github.com/emersion/go-message/mail"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploadRecorder is a storage api recording the uploaded objects (key => content), in order
+type uploadRecorder struct {
+	mutex   sync.Mutex
+	fail    bool
+	keys    []string
+	objects map[string]string
+}
+
+func (s *uploadRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fail || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	key := strings.TrimPrefix(r.URL.Path, "/api/v1/storage/bucket/")
+	s.keys = append(s.keys, key)
+	s.objects[key] = string(data)
+}
+
+const testArchivedMessage = "From: Billing <billing@example.com>\r\n" +
+	"To: scans@example.net, Archive <archive@example.net>\r\n" +
+	"Subject: =?utf-8?Q?Re=C3=A7u?= <2021>\r\n" +
+	"Date: Thu, 04 Mar 2021 23:30:00 +0000\r\n" +
+	"Message-Id: <1234@mail.example.com>\r\n" +
+	"\r\n" +
+	"body\r\n"
+
+func TestBodyFilename(t *testing.T) {
+	tests := []struct {
+		storeBody   string
+		contentType string
+		want        string
+	}{
+		{storeBody: "none", contentType: "text/plain", want: ""},
+		{storeBody: "text", contentType: "text/plain", want: textBodyFilename},
+		{storeBody: "text", contentType: "text/html", want: ""},
+		{storeBody: "html", contentType: "text/html; charset=utf-8", want: htmlBodyFilename},
+		{storeBody: "html", contentType: "text/plain", want: ""},
+		{storeBody: "both", contentType: "text/plain", want: textBodyFilename},
+		{storeBody: "both", contentType: "text/html", want: htmlBodyFilename},
+		{storeBody: "both", contentType: "text/calendar", want: ""},
+		{storeBody: "both", contentType: "invalid/", want: ""},
+	}
+	for _, test := range tests {
+		var h mail.InlineHeader
+		h.Set("Content-Type", test.contentType)
+		if got := bodyFilename(EmailConfig{StoreBody: test.storeBody}, &h); got != test.want {
+			t.Errorf("bodyFilename(%q, %q) = %q, want %q", test.storeBody, test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestArchiveMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   EmailConfig
+		bodies   []string
+		fail     bool
+		wantKeys []string
+		wantErr  string
+	}{
+		{name: "nothing archived", config: EmailConfig{StoreBody: "none"}, wantKeys: []string{}},
+		{name: "eml", config: EmailConfig{StoreEml: true}, wantKeys: []string{"42/message.eml"}},
+		{
+			// the metadata is stored last, as it lists the other objects
+			name:     "everything",
+			config:   EmailConfig{StoreEml: true, StoreBody: "both", StoreMetadata: true},
+			bodies:   []string{htmlBodyFilename, textBodyFilename},
+			wantKeys: []string{"42/body.txt", "42/body.html", "42/message.eml", "42/metadata.json"},
+		},
+		{name: "metadata only", config: EmailConfig{StoreMetadata: true}, wantKeys: []string{"42/metadata.json"}},
+		{name: "storage error", config: EmailConfig{StoreBody: "text", StoreMetadata: true}, bodies: []string{textBodyFilename}, fail: true, wantErr: "error storing the message body"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &uploadRecorder{fail: test.fail, keys: []string{}, objects: map[string]string{}}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+
+			localTempDir := t.TempDir()
+			bodies := map[string]string{}
+			for _, filename := range test.bodies {
+				bodies[filename] = filepath.Join(localTempDir, filename)
+				if err := ioutil.WriteFile(bodies[filename], []byte(filename), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mr, err := mail.CreateReader(strings.NewReader(testArchivedMessage))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.config.Bucket = "bucket"
+			test.config.KeyTemplate = "{uid}/{index}/{filename}"
+			test.config.KeyCollision = "overwrite"
+			ew := newTestEmailWatcher(test.config)
+			ew.storageClient = storage.NewClient(server.URL)
+			fields := keyFields{Uid: 42, Mailbox: "INBOX", Index: 2, Filename: "invoice.pdf"}
+			attachments := []storedObject{{storagePath: "42/2/invoice.pdf"}}
+
+			archived, err := ew.archiveMessage(context.Background(), test.config, fields, mr.Header, []byte(testArchivedMessage), bodies, attachments, localTempDir)
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Errorf("archiveMessage() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archivedKeys := []string{}
+			for _, object := range archived {
+				archivedKeys = append(archivedKeys, object.storagePath)
+			}
+			if !reflect.DeepEqual(archivedKeys, test.wantKeys) {
+				t.Errorf("archived %q, want %q", archivedKeys, test.wantKeys)
+			}
+			if !reflect.DeepEqual(recorder.keys, test.wantKeys) {
+				t.Errorf("uploaded %q, want %q", recorder.keys, test.wantKeys)
+			}
+			if eml, ok := recorder.objects["42/message.eml"]; ok && eml != testArchivedMessage {
+				t.Errorf("message.eml = %q, want the raw message", eml)
+			}
+		})
+	}
+}
+
+func TestArchiveMessageMetadata(t *testing.T) {
+	recorder := &uploadRecorder{objects: map[string]string{}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	localTempDir := t.TempDir()
+	textBody := filepath.Join(localTempDir, textBodyFilename)
+	if err := ioutil.WriteFile(textBody, []byte("body"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mr, err := mail.CreateReader(strings.NewReader(testArchivedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emailConfig := EmailConfig{Bucket: "bucket", KeyTemplate: "{uid}/{filename}", KeyCollision: "overwrite", StoreEml: true, StoreBody: "text", StoreMetadata: true}
+	ew := newTestEmailWatcher(emailConfig)
+	ew.storageClient = storage.NewClient(server.URL)
+	fields := keyFields{Uid: 42, Mailbox: "INBOX/Receipts"}
+	attachments := []storedObject{{storagePath: "42/invoice.pdf"}, {storagePath: "42/invoice-1.pdf"}}
+	if _, err := ew.archiveMessage(context.Background(), emailConfig, fields, mr.Header, []byte(testArchivedMessage), map[string]string{textBodyFilename: textBody}, attachments, localTempDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata emailMetadata
+	if err := json.Unmarshal([]byte(recorder.objects["42/metadata.json"]), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2021, 3, 4, 23, 30, 0, 0, time.UTC)
+	want := emailMetadata{
+		MessageId:   "<1234@mail.example.com>",
+		Date:        &date,
+		From:        []emailAddress{{Name: "Billing", Address: "billing@example.com"}},
+		To:          []emailAddress{{Address: "scans@example.net"}, {Name: "Archive", Address: "archive@example.net"}},
+		Cc:          []emailAddress{},
+		Subject:     "Reçu <2021>",
+		Mailbox:     "INBOX/Receipts",
+		Uid:         42,
+		Message:     "42/message.eml",
+		Body:        []string{"42/body.txt"},
+		Attachments: []string{"42/invoice.pdf", "42/invoice-1.pdf"},
+	}
+	if metadata.Date == nil || !metadata.Date.Equal(date) {
+		t.Errorf("date = %v, want %v", metadata.Date, date)
+	}
+	metadata.Date = want.Date
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("metadata = %+v, want %+v", metadata, want)
+	}
+
+	// the message id is not escaped
+	if !strings.Contains(recorder.objects["42/metadata.json"], `"messageId": "<1234@mail.example.com>"`) {
+		t.Errorf("metadata.json = %v", recorder.objects["42/metadata.json"])
+	}
+}
@@ -0,0 +1,240 @@
+package watch
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/text/unicode/norm"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest filename (in bytes) that is kept, well below the usual 255 bytes limit of filesystems
+const maxFilenameLength = 200
+
+// names that can't be used as filenames on Windows, with or without an extension
+var reservedFilenames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// attachmentFilename returns the decoded & sanitized filename of the attachment. Attachments without a (usable) name
+// are named after their position in the message, and their declared content type, eg. "attachment-2.pdf".
+func attachmentFilename(h *mail.AttachmentHeader, index int) string {
+	// the mime package drops (or partially decodes) RFC 2231 values in charsets other than UTF-8, and fails on
+	// malformed headers, so the parameters are parsed here. Using "name" in Content-Type is discouraged, but common.
+	filename := rfc2231Param(h.Get("Content-Disposition"), "filename")
+	if filename == "" {
+		filename = rfc2231Param(h.Get("Content-Type"), "name")
+	}
+	if filename == "" {
+		filename, _ = h.Filename()
+	}
+
+	// RFC 2047 encoded words (not allowed in parameters, but common), in any charset
+	if strings.Contains(filename, "=?") {
+		decoder := mime.WordDecoder{CharsetReader: charset.Reader}
+		if decoded, err := decoder.DecodeHeader(filename); err == nil {
+			filename = decoded
+		}
+	}
+
+	if filename = sanitizeFilename(filename); filename != "" {
+		return filename
+	}
+	filename = fmt.Sprintf("attachment-%d", index)
+	if contentType, _, err := h.ContentType(); err == nil {
+		if detected := mimetype.Lookup(contentType); detected != nil {
+			filename += detected.Extension()
+		}
+	}
+	return filename
+}
+
+// sanitizeFilename returns a filename that is safe to use as a single path segment, in object keys and local paths:
+//   - invalid UTF-8 is replaced, and the name is normalized to NFC (so that the same name always gives the same key)
+//   - directories are removed, only the base name is kept
+//   - control characters and characters reserved on Windows are replaced with _
+//   - bidirectional control characters (that can disguise the extension) are removed
+//   - runs of dots are collapsed, and leading & trailing spaces and dots are trimmed, so the name can't be (or
+//     contain) ".."
+//   - reserved Windows device names (eg. "con.pdf") are prefixed with _
+//   - long names are truncated, keeping the extension
+//
+// Returns an empty string if nothing is left.
+func sanitizeFilename(filename string) string {
+	name := strings.ToValidUTF8(filename, "_")
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		if unicode.IsControl(r) || strings.ContainsRune(`:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	for strings.Contains(name, "..") {
+		name = strings.ReplaceAll(name, "..", ".")
+	}
+	name = strings.TrimFunc(norm.NFC.String(name), isTrimmedFromFilename)
+	if name == "" {
+		return ""
+	}
+
+	if stem := strings.SplitN(name, ".", 2)[0]; reservedFilenames[strings.ToLower(strings.TrimRightFunc(stem, unicode.IsSpace))] {
+		name = "_" + name
+	}
+
+	if len(name) > maxFilenameLength {
+		extension := ""
+		if i := strings.LastIndex(name, "."); i > 0 && len(name)-i <= 16 {
+			extension = name[i:]
+		}
+		stem := name[:maxFilenameLength-len(extension)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = strings.TrimRightFunc(stem, isTrimmedFromFilename) + extension
+	}
+	return name
+}
+
+func isTrimmedFromFilename(r rune) bool {
+	return r == '.' || unicode.IsSpace(r)
+}
+
+// rfc2231Param extracts a parameter from a raw header value, with RFC 2231 continuations (name*0, name*1, ...) and
+// charset encoding (name*=charset'language'%xx) decoded. It tolerates malformed parameters, and decodes any charset
+// supported by go-message.
+func rfc2231Param(header string, name string) string {
+	type section struct {
+		value   string
+		encoded bool
+	}
+	sections := map[int]section{}
+	for _, param := range splitParams(header) {
+		key, value := param[0], param[1]
+		encoded := strings.HasSuffix(key, "*")
+		key = strings.TrimSuffix(key, "*")
+
+		number := 0
+		if key != name {
+			if !strings.HasPrefix(key, name+"*") {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(key, name+"*"))
+			if err != nil || n < 0 {
+				continue
+			}
+			number = n
+		}
+		// the extended (name*) value takes precedence over the plain one
+		if existing, ok := sections[number]; !ok || !existing.encoded {
+			sections[number] = section{value: value, encoded: encoded}
+		}
+	}
+	if len(sections) == 0 {
+		return ""
+	}
+
+	numbers := []int{}
+	for number := range sections {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	// the charset is declared by the first section only
+	charsetName := ""
+	if first := sections[numbers[0]]; first.encoded {
+		if parts := strings.SplitN(first.value, "'", 3); len(parts) == 3 {
+			charsetName = parts[0]
+			sections[numbers[0]] = section{value: parts[2], encoded: true}
+		}
+	}
+
+	var raw bytes.Buffer
+	for _, number := range numbers {
+		section := sections[number]
+		if !section.encoded {
+			raw.WriteString(section.value)
+		} else if unescaped, err := url.PathUnescape(section.value); err == nil {
+			raw.WriteString(unescaped)
+		} else {
+			raw.WriteString(section.value)
+		}
+	}
+
+	if charsetName == "" || strings.EqualFold(charsetName, "utf-8") || strings.EqualFold(charsetName, "us-ascii") {
+		return raw.String()
+	}
+	reader, err := charset.Reader(charsetName, &raw)
+	if err != nil {
+		return raw.String()
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return raw.String()
+	}
+	return string(decoded)
+}
+
+// splitParams splits the parameters of a header value (after the first ;) into lowercase keys and unquoted values
+func splitParams(header string) [][2]string {
+	params := [][2]string{}
+	inQuotes := false
+	start := -1
+	for i := 0; i <= len(header); i++ {
+		if i < len(header) {
+			switch header[i] {
+			case '"':
+				inQuotes = !inQuotes
+				continue
+			case '\\':
+				if inQuotes {
+					i++
+				}
+				continue
+			case ';':
+				if inQuotes {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if start >= 0 {
+			if param := strings.SplitN(header[start:i], "=", 2); len(param) == 2 {
+				params = append(params, [2]string{
+					strings.ToLower(strings.TrimSpace(param[0])),
+					unquote(strings.TrimSpace(param[1])),
+				})
+			}
+		}
+		start = i + 1
+	}
+	return params
+}
+
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	var unquoted strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		if value[i] == '\\' && i+1 < len(value)-1 {
+			i++
+		}
+		unquoted.WriteByte(value[i])
+	}
+	return unquoted.String()
+}
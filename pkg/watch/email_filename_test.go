@@ -0,0 +1,154 @@
+package watch
+
+import (
+	"github.com/emersion/go-message/mail"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// malformed and hostile inputs, both used as filenames and as Content-Disposition filename parameters
+var filenameSeeds = []string{
+	"invoice.pdf",
+	"../../other-bucket/x",
+	"..\\x",
+	"C:\\Users\\scan\\invoice.pdf",
+	"/etc/passwd",
+	"a\x00b\x1f\x7f.pdf",
+	"invoice\u202Efdp.exe",
+	"\u200Finvoice\u2066.pdf\u2069",
+	"",
+	".",
+	"..",
+	"....",
+	". . .",
+	"report..final.pdf",
+	"con.pdf",
+	"LPT1 .txt",
+	"e\u0301\u0301.pdf",
+	"\xff\xfe.pdf",
+	"\xe2\x82",
+	strings.Repeat("a", 300) + ".pdf",
+	strings.Repeat("é", 150) + ".pdf",
+}
+
+// headerSeeds are Content-Disposition headers, with RFC 2231 continuations and charsets, and RFC 2047 encoded words
+var headerSeeds = []string{
+	`attachment; filename="invoice.pdf"`,
+	`attachment; filename*0*=iso-8859-1''r%E9sum; filename*1*=%E9.pdf`,
+	`attachment; filename*0="long "; filename*1="name.pdf"`,
+	`attachment; filename*1*=%2E%2E; filename*0*=UTF-8''%2E%2E%2F`,
+	`attachment; filename*=UTF-8''%2E%2E%2F%2E%2E%2Fother-bucket%2Fx`,
+	`attachment; filename*=windows-1251''%D1%F7%B8%F2.pdf`,
+	`attachment; filename*=unknown-charset''%FF.pdf; filename="plain.pdf"`,
+	`attachment; filename="=?iso-8859-1?Q?r=E9sum=E9.pdf?="`,
+	`attachment; filename="=?windows-1251?B?0fe48i5wZGY=?="`,
+	`attachment; filename="=?shift_jis?B?kL+LgY+RLnBkZg==?="`,
+	`attachment; filename="=?iso-2022-jp?B?GyRCQEE1YT1xGyhCLnBkZg==?="`,
+	`attachment; filename="=?utf-8?Q?=2E=2E=2F=2E=2E=2Fx?="`,
+	`attachment; filename="..\\..\\x.pdf"`,
+	`attachment; filename="unterminated`,
+	`attachment; filename*0*=%ZZ; filename*-1=x`,
+	`attachment`,
+}
+
+// checkFilename asserts that the filename is a single, normalized path segment
+func checkFilename(t *testing.T, input string, filename string) {
+	t.Helper()
+	if strings.ContainsAny(filename, `/\`) || strings.Contains(filename, "..") {
+		t.Errorf("%q: filename %q is not a single path segment", input, filename)
+	}
+	if !utf8.ValidString(filename) {
+		t.Errorf("%q: filename %q is not valid UTF-8", input, filename)
+	}
+	for _, r := range filename {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			t.Errorf("%q: filename %q contains the control character %U", input, filename, r)
+		}
+	}
+	if !norm.NFC.IsNormalString(filename) {
+		t.Errorf("%q: filename %q is not NFC", input, filename)
+	}
+	if len(filename) > maxFilenameLength {
+		t.Errorf("%q: filename %q is longer than %d bytes", input, filename, maxFilenameLength)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"invoice.pdf":                     "invoice.pdf",
+		"../../other-bucket/x":            "x",
+		"..\\x":                           "x",
+		"a\x00b\x1f.pdf":                  "a_b_.pdf",
+		"invoice\u202Efdp.exe":            "invoicefdp.exe",
+		"a:b*?.pdf":                       "a_b__.pdf",
+		"":                                "",
+		"...":                             "",
+		". . .":                           "",
+		" .hidden. ":                      "hidden",
+		"report..final.pdf":               "report.final.pdf",
+		"con.pdf":                         "_con.pdf",
+		"e\u0301.pdf":                     "\u00e9.pdf",
+		"\xff\xfe.pdf":                    "_.pdf",
+		strings.Repeat("a", 300) + ".pdf": strings.Repeat("a", maxFilenameLength-4) + ".pdf",
+	}
+	for filename, want := range tests {
+		if got := sanitizeFilename(filename); got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	tests := map[string]string{
+		`attachment; filename*0*=iso-8859-1''r%E9sum; filename*1*=%E9.pdf`:  "résumé.pdf",
+		`attachment; filename*0="long "; filename*1="name.pdf"`:             "long name.pdf",
+		`attachment; filename*=windows-1251''%D1%F7%B8%F2.pdf`:              "Счёт.pdf",
+		`attachment; filename*=UTF-8''%2E%2E%2F%2E%2E%2Fother-bucket%2Fx`:   "x",
+		`attachment; filename="=?iso-8859-1?Q?r=E9sum=E9.pdf?="`:            "résumé.pdf",
+		`attachment; filename="=?windows-1251?B?0fe48i5wZGY=?="`:            "Счёт.pdf",
+		`attachment; filename="=?shift_jis?B?kL+LgY+RLnBkZg==?="`:           "請求書.pdf",
+		`attachment; filename="=?iso-2022-jp?B?GyRCQEE1YT1xGyhCLnBkZg==?="`: "請求書.pdf",
+		`attachment; filename="=?utf-8?Q?=2E=2E=2F=2E=2E=2Fx?="`:            "x",
+		`attachment`: "attachment-1.pdf",
+	}
+	for header, want := range tests {
+		var h mail.AttachmentHeader
+		h.Set("Content-Disposition", header)
+		h.Set("Content-Type", "application/pdf")
+		if got := attachmentFilename(&h, 1); got != want {
+			t.Errorf("attachmentFilename(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestSanitizeFilenameSeeds(t *testing.T) {
+	for _, filename := range filenameSeeds {
+		sanitized := sanitizeFilename(filename)
+		checkFilename(t, filename, sanitized)
+		if again := sanitizeFilename(sanitized); again != sanitized {
+			t.Errorf("%q: sanitizing %q again gives %q", filename, sanitized, again)
+		}
+	}
+}
+
+func TestRfc2231ParamSeeds(t *testing.T) {
+	headers := append([]string{}, headerSeeds...)
+	for _, seed := range filenameSeeds {
+		headers = append(headers, `attachment; filename="`+seed+`"`, `attachment; filename*=UTF-8''`+seed)
+	}
+	for _, header := range headers {
+		rfc2231Param(header, "filename")
+
+		// the decoded parameter is only used after sanitizing, as the attachment filename
+		var h mail.AttachmentHeader
+		h.Set("Content-Disposition", header)
+		filename := attachmentFilename(&h, 1)
+		if filename == "" {
+			t.Errorf("%q: empty filename", header)
+		}
+		checkFilename(t, header, filename)
+	}
+}
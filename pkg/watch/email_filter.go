@@ -0,0 +1,126 @@
+package watch
+
+import (
+	"fmt"
+	"github.com/gabriel-vasile/mimetype"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// document-oriented defaults: office documents, PDFs, text and scanned images. Signature logos are skipped by the
+// minimum size, calendar invites, videos and archives by type.
+var defaultAttachmentTypes = []string{
+	"application/pdf",
+	"application/msword",
+	"application/vnd.ms-excel",
+	"application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+	"text/rtf",
+	"text/plain",
+	"text/csv",
+	"image/jpeg",
+	"image/png",
+	"image/tiff",
+	"image/heic",
+}
+
+var defaultAttachmentExtensions = []string{
+	"pdf", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "odt", "ods", "odp", "rtf", "txt", "csv",
+	"jpg", "jpeg", "png", "tif", "tiff", "heic",
+}
+
+const (
+	defaultAttachmentMinSize = 10 * 1024        // 10 KiB
+	defaultAttachmentMaxSize = 25 * 1024 * 1024 // 25 MiB
+)
+
+// SkippedError is returned for attachments that don't match the attachment rules. Skipped attachments are not
+// stored, but don't fail the message.
+type SkippedError struct {
+	// "name", "extension", "size" or "type"
+	Rule   string
+	Reason string
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("attachment skipped (%s): %s", e.Rule, e.Reason)
+}
+
+// checkAttachmentName checks the filename against the "attachment-exclude" & "attachment-include" globs, and the
+// extension against "attachment-extensions", before anything is saved.
+func checkAttachmentName(emailConfig EmailConfig, filename string) *SkippedError {
+	name := strings.ToLower(filepath.Base(filename))
+	if matchesGlob(emailConfig.AttachmentExclude, name) {
+		return &SkippedError{Rule: "name", Reason: fmt.Sprintf("%v is excluded", filename)}
+	}
+	if len(emailConfig.AttachmentInclude) > 0 && !matchesGlob(emailConfig.AttachmentInclude, name) {
+		return &SkippedError{Rule: "name", Reason: fmt.Sprintf("%v is not included", filename)}
+	}
+
+	if !containsWildcard(emailConfig.AttachmentExtensions) {
+		extension := strings.TrimPrefix(path.Ext(name), ".")
+		allowed := false
+		for _, entry := range emailConfig.AttachmentExtensions {
+			if strings.ToLower(strings.TrimPrefix(entry, ".")) == extension {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return &SkippedError{Rule: "extension", Reason: fmt.Sprintf("extension %q is not allowed", extension)}
+		}
+	}
+	return nil
+}
+
+// checkAttachmentFile checks the size of the saved attachment against "attachment-min-size" & "attachment-max-size",
+// and its content type against "attachment-types". The type is detected from the content, as the declared type (and
+// extension) can't be trusted.
+func checkAttachmentFile(emailConfig EmailConfig, localPath string) *SkippedError {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return &SkippedError{Rule: "size", Reason: err.Error()}
+	}
+	if info.Size() < int64(emailConfig.AttachmentMinSize) {
+		return &SkippedError{Rule: "size", Reason: fmt.Sprintf("%d bytes is below the minimum size", info.Size())}
+	}
+	if emailConfig.AttachmentMaxSize > 0 && info.Size() > int64(emailConfig.AttachmentMaxSize) {
+		return &SkippedError{Rule: "size", Reason: fmt.Sprintf("exceeds the maximum size of %d bytes", emailConfig.AttachmentMaxSize)}
+	}
+
+	if containsWildcard(emailConfig.AttachmentTypes) {
+		return nil
+	}
+	detected, err := mimetype.DetectFile(localPath)
+	if err != nil {
+		return &SkippedError{Rule: "type", Reason: err.Error()}
+	}
+	// only the detected type is matched, not its parents: text/plain must not allow every text format (eg. text/calendar)
+	mediaType := strings.SplitN(detected.String(), ";", 2)[0]
+	if !matchesGlob(emailConfig.AttachmentTypes, mediaType) {
+		return &SkippedError{Rule: "type", Reason: fmt.Sprintf("content type %v is not allowed", mediaType)}
+	}
+	return nil
+}
+
+// matchesGlob returns true if the value matches any of the (case insensitive) globs
+func matchesGlob(globs []string, value string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(strings.ToLower(glob), value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// containsWildcard returns true if the list allows anything ("*")
+func containsWildcard(list []string) bool {
+	for _, entry := range list {
+		if entry == "*" || entry == "*/*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package watch
+
+import (
+	"context"
+	"github.com/emersion/go-imap/client"
+	"time"
+)
+
+// waitForMessages returns when the server reports that the number of messages in the mailbox changed (IMAP IDLE),
+// or after "imap-interval" seconds, or when the context is cancelled. If the server doesn't support IDLE (or it is
+// disabled), it simply waits for "imap-interval" seconds.
+func (ew *EmailWatcher) waitForMessages(ctx context.Context, c *client.Client, mailboxChanged <-chan bool) {
+	emailConfig := ew.currentConfig()
+	interval := time.NewTimer(emailConfig.ImapInterval)
+	defer interval.Stop()
+
+	idle := false
+	if emailConfig.ImapIdle {
+		supported, err := c.Support("IDLE")
+		if err != nil {
+			ew.logger.Warnf("Could not check if the server supports IDLE, polling instead: %v", err)
+		} else if !supported {
+			ew.logger.Debugln("Server doesn't support IDLE, polling instead")
+		}
+		idle = supported
+	}
+	if !idle {
+		ew.logger.Printf("Sleeping for %v...", emailConfig.ImapInterval)
+		select {
+		case <-ctx.Done():
+		case <-interval.C:
+		}
+		return
+	}
+
+	// updates received while processing the mailbox (eg. when selecting it) are not new messages
+	select {
+	case <-mailboxChanged:
+	default:
+	}
+
+	ew.logger.Printf("Waiting for new messages (IDLE), for at most %v...", emailConfig.ImapInterval)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, &client.IdleOptions{LogoutTimeout: imapIdleRestart})
+	}()
+
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-interval.C:
+			break wait
+		case <-mailboxChanged:
+			ew.logger.Debugln("Mailbox changed, processing new messages")
+			break wait
+		case err := <-done:
+			// eg. the session was lost, which Start handles
+			ew.logger.Warnf("IDLE failed: %v", err)
+			return
+		}
+	}
+
+	close(stop)
+	if err := <-done; err != nil {
+		ew.logger.Warnf("IDLE failed: %v", err)
+	}
+}
+
+// consumeUpdates reads the unsolicited updates sent by the server until the client is logged out (the client blocks
+// until each update is consumed), signalling mailboxChanged when the selected mailbox changed (eg. EXISTS responses
+// for new messages).
+func consumeUpdates(updates <-chan client.Update, loggedOut <-chan struct{}, mailboxChanged chan<- bool) {
+	for {
+		select {
+		case <-loggedOut:
+			return
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); !ok {
+				continue
+			}
+			select {
+			case mailboxChanged <- true:
+			default:
+			}
+		}
+	}
+}
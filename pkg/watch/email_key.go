@@ -0,0 +1,161 @@
+package watch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/model"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default key is unique per message, so that attachments with the same name from different messages don't
+// overwrite each other
+const defaultKeyTemplate = "email/{date}/{message-hash}/{filename}"
+
+// How many suffixes are tried ("key-collision": suffix) before giving up
+const maxKeySuffix = 100
+
+var keyPlaceholderPattern = regexp.MustCompile(`{([a-z-]*)}`)
+
+// keyFields are the values of the "key-template" placeholders for an attachment
+type keyFields struct {
+	Date      time.Time
+	Sender    string
+	MessageId string
+	Uid       uint32
+	Mailbox   string
+	Index     int
+	Filename  string
+}
+
+// keyPlaceholders renders each placeholder. Values are sanitized, so that they can't add path segments to the key.
+var keyPlaceholders = map[string]func(fields keyFields) string{
+	"date":          func(f keyFields) string { return f.Date.Format("2006-01-02") },
+	"year":          func(f keyFields) string { return f.Date.Format("2006") },
+	"month":         func(f keyFields) string { return f.Date.Format("01") },
+	"day":           func(f keyFields) string { return f.Date.Format("02") },
+	"sender":        func(f keyFields) string { return sanitizeKeySegment(strings.ToLower(f.Sender)) },
+	"sender-domain": func(f keyFields) string { return sanitizeKeySegment(senderDomain(f.Sender)) },
+	"message-hash":  func(f keyFields) string { return messageHash(f.MessageId) },
+	"uid":           func(f keyFields) string { return strconv.FormatUint(uint64(f.Uid), 10) },
+	"mailbox":       func(f keyFields) string { return sanitizeKeySegment(f.Mailbox) },
+	"index":         keyIndex,
+	"filename":      keyFilename,
+}
+
+// validateKeyTemplate checks that the template only uses known placeholders
+func validateKeyTemplate(template string) error {
+	for _, match := range keyPlaceholderPattern.FindAllStringSubmatch(template, -1) {
+		if _, ok := keyPlaceholders[match[1]]; !ok {
+			return fmt.Errorf("unknown placeholder %v", match[0])
+		}
+	}
+	return nil
+}
+
+// renderKey replaces the placeholders of the "key-template" with the attachment's values
+func renderKey(template string, fields keyFields) string {
+	key := keyPlaceholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if render, ok := keyPlaceholders[strings.Trim(placeholder, "{}")]; ok {
+			return render(fields)
+		}
+		return placeholder
+	})
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// resolveKeyCollision applies the "key-collision" strategy to the rendered key, returning the key to upload to, and
+// whether the upload can be skipped (the identical object is already stored):
+//   - overwrite: the key is used as is
+//   - hash: the (shortened) content hash is added to the filename, so only identical attachments share a key
+//   - suffix: a numeric suffix is added to the filename, until an unused key is found
+//   - skip-identical: like suffix, unless the object stored at the key has the same ETag
+func (ew *EmailWatcher) resolveKeyCollision(ctx context.Context, emailConfig EmailConfig, key string, localPath string) (string, bool, error) {
+	switch emailConfig.KeyCollision {
+	case "overwrite":
+		return key, false, nil
+	case "hash":
+		etag, err := model.FileMD5Hash(localPath)
+		if err != nil {
+			return "", false, err
+		}
+		return keyWithSuffix(key, etag[:8]), false, nil
+	}
+
+	var etag string
+	if emailConfig.KeyCollision == "skip-identical" {
+		var err error
+		if etag, err = model.FileMD5Hash(localPath); err != nil {
+			return "", false, err
+		}
+	}
+	for i := 0; i <= maxKeySuffix; i++ {
+		candidate := key
+		if i > 0 {
+			candidate = keyWithSuffix(key, strconv.Itoa(i))
+		}
+		info, err := ew.storageClient.Stat(ctx, emailConfig.Bucket, candidate)
+		if err != nil {
+			return "", false, fmt.Errorf("error checking if %v exists: %v", candidate, err)
+		}
+		if info == nil {
+			return candidate, false, nil
+		}
+		if etag != "" && info.ETag == etag {
+			return candidate, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("no unused key found for %v after %d attempts", key, maxKeySuffix)
+}
+
+// keyWithSuffix adds "-suffix" to the filename of the key, before the extension
+func keyWithSuffix(key string, suffix string) string {
+	extension := path.Ext(path.Base(key))
+	return strings.TrimSuffix(key, extension) + "-" + suffix + extension
+}
+
+// messageHash is a short, stable identifier of the message derived from its Message-ID
+func messageHash(messageId string) string {
+	sum := sha256.Sum256([]byte(strings.Trim(strings.TrimSpace(messageId), "<>")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func senderDomain(sender string) string {
+	return strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+}
+
+// sanitizeKeySegment replaces anything but letters, digits, and . _ @ - with _, so that the value is a single path
+// segment
+func sanitizeKeySegment(value string) string {
+	segment := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("._@-", r) {
+			return r
+		}
+		return '_'
+	}, value)
+	if strings.Trim(segment, ".") == "" {
+		return "_"
+	}
+	return segment
+}
+
+// keyFilename is the attachment filename (see attachmentFilename), sanitized again in case it was set elsewhere
+func keyFilename(f keyFields) string {
+	if filename := sanitizeFilename(f.Filename); filename != "" {
+		return filename
+	}
+	return fmt.Sprintf("attachment-%d", f.Index)
+}
+
+// keyIndex is the position of the attachment in the message, or empty for the archived parts of the message
+func keyIndex(f keyFields) string {
+	if f.Index < 0 {
+		return ""
+	}
+	return strconv.Itoa(f.Index)
+}
@@ -0,0 +1,255 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/storage"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderKey(t *testing.T) {
+	fields := keyFields{
+		Date:      time.Date(2021, 3, 4, 23, 30, 0, 0, time.UTC),
+		Sender:    "Billing@Example.COM",
+		MessageId: "<1234@mail.example.com>",
+		Uid:       42,
+		Mailbox:   "INBOX/Receipts",
+		Index:     2,
+		Filename:  "invoice.pdf",
+	}
+	tests := []struct {
+		template string
+		fields   func(f *keyFields)
+		want     string
+	}{
+		{template: defaultKeyTemplate, want: "email/2021-03-04/" + messageHash("<1234@mail.example.com>") + "/invoice.pdf"},
+		{template: "{year}/{month}/{day}/{uid}-{index}-{filename}", want: "2021/03/04/42-2-invoice.pdf"},
+		{template: "{sender-domain}/{sender}/{filename}", want: "example.com/billing@example.com/invoice.pdf"},
+		{template: "{mailbox}/{filename}", want: "INBOX_Receipts/invoice.pdf"},
+
+		// archived parts of the message have no index
+		{template: "{uid}/{index}/{filename}", fields: func(f *keyFields) { f.Index = -1 }, want: "42/invoice.pdf"},
+		{template: "{uid}-{index}", fields: func(f *keyFields) { f.Index = -1 }, want: "42-"},
+
+		// values can't add (or escape) path segments
+		{template: "{filename}", fields: func(f *keyFields) { f.Filename = "../../other-bucket/x.pdf" }, want: "x.pdf"},
+		{template: "{filename}", fields: func(f *keyFields) { f.Filename = ".." }, want: "attachment-2"},
+		{template: "{sender}/{filename}", fields: func(f *keyFields) { f.Sender = "../@.." }, want: ".._@../invoice.pdf"},
+		{template: "{mailbox}/{filename}", fields: func(f *keyFields) { f.Mailbox = ".." }, want: "_/invoice.pdf"},
+		{template: "{sender-domain}/{filename}", fields: func(f *keyFields) { f.Sender = "nobody" }, want: "nobody/invoice.pdf"},
+
+		// the template itself is cleaned
+		{template: "/docs//{filename}", want: "docs/invoice.pdf"},
+		{template: "../../{filename}", want: "invoice.pdf"},
+		{template: "a/../{filename}", want: "invoice.pdf"},
+		{template: "{unknown}/{filename}", want: "{unknown}/invoice.pdf"},
+	}
+	for _, test := range tests {
+		f := fields
+		if test.fields != nil {
+			test.fields(&f)
+		}
+		if got := renderKey(test.template, f); got != test.want {
+			t.Errorf("renderKey(%q) = %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestValidateKeyTemplate(t *testing.T) {
+	// placeholders are lowercase, anything else is kept literally
+	for _, template := range []string{defaultKeyTemplate, "{year}/{month}/{day}/{sender-domain}/{sender}/{uid}-{index}-{mailbox}", "static/{Date}"} {
+		if err := validateKeyTemplate(template); err != nil {
+			t.Errorf("validateKeyTemplate(%q) = %v", template, err)
+		}
+	}
+	for template, want := range map[string]string{
+		"{date}/{name}":  "unknown placeholder {name}",
+		"{}/{filename}":  "unknown placeholder {}",
+		"{message-id}/x": "unknown placeholder {message-id}",
+	} {
+		if err := validateKeyTemplate(template); err == nil || err.Error() != want {
+			t.Errorf("validateKeyTemplate(%q) = %v, want %q", template, err, want)
+		}
+	}
+}
+
+func TestMessageHash(t *testing.T) {
+	hash := messageHash("<1234@mail.example.com>")
+	if len(hash) != 16 {
+		t.Errorf("messageHash() = %q, want 16 characters", hash)
+	}
+	for _, messageId := range []string{"1234@mail.example.com", " <1234@mail.example.com> "} {
+		if got := messageHash(messageId); got != hash {
+			t.Errorf("messageHash(%q) = %q, want %q", messageId, got, hash)
+		}
+	}
+	if messageHash("<5678@mail.example.com>") == hash {
+		t.Error("different messages have the same hash")
+	}
+}
+
+func TestKeyWithSuffix(t *testing.T) {
+	tests := map[string]string{
+		"a/invoice.pdf":     "a/invoice-1.pdf",
+		"a/archive.tar.gz":  "a/archive.tar-1.gz",
+		"a.b/no-extension":  "a.b/no-extension-1",
+		"invoice.pdf":       "invoice-1.pdf",
+		"email/x/metadata.": "email/x/metadata-1.",
+	}
+	for key, want := range tests {
+		if got := keyWithSuffix(key, "1"); got != want {
+			t.Errorf("keyWithSuffix(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// stubStorage answers HEAD requests for the objects it holds (key => ETag), and records the requested keys
+type stubStorage struct {
+	objects  map[string]string
+	fail     bool
+	requests []string
+}
+
+func (s *stubStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/api/v1/storage/bucket/")
+	s.requests = append(s.requests, r.Method+" "+key)
+	if s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	etag, ok := s.objects[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
+func TestResolveKeyCollision(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "invoice.pdf")
+	if err := ioutil.WriteFile(localPath, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const identical = "5d41402abc4b2a76b9719d911017c592" // md5 of "hello"
+	const key = "email/invoice.pdf"
+
+	allTaken := map[string]string{key: "other"}
+	for i := 1; i <= maxKeySuffix; i++ {
+		allTaken[fmt.Sprintf("email/invoice-%d.pdf", i)] = "other"
+	}
+
+	tests := []struct {
+		name         string
+		strategy     string
+		objects      map[string]string
+		fail         bool
+		wantKey      string
+		wantSkip     bool
+		wantErr      string
+		wantRequests int
+	}{
+		{name: "overwrite", strategy: "overwrite", objects: map[string]string{key: "other"}, wantKey: key},
+		{name: "hash", strategy: "hash", objects: map[string]string{key: "other"}, wantKey: "email/invoice-5d41402a.pdf"},
+
+		{name: "suffix, unused key", strategy: "suffix", wantKey: key, wantRequests: 1},
+		{
+			name:         "suffix, used keys",
+			strategy:     "suffix",
+			objects:      map[string]string{key: "other", "email/invoice-1.pdf": "other"},
+			wantKey:      "email/invoice-2.pdf",
+			wantRequests: 3,
+		},
+		{
+			name:         "suffix ignores identical objects",
+			strategy:     "suffix",
+			objects:      map[string]string{key: identical},
+			wantKey:      "email/invoice-1.pdf",
+			wantRequests: 2,
+		},
+		{name: "suffix, no unused key", strategy: "suffix", objects: allTaken, wantErr: "no unused key found for email/invoice.pdf after 100 attempts", wantRequests: maxKeySuffix + 1},
+
+		{name: "skip-identical, unused key", strategy: "skip-identical", wantKey: key, wantRequests: 1},
+		{
+			name:         "skip-identical, identical object",
+			strategy:     "skip-identical",
+			objects:      map[string]string{key: identical},
+			wantKey:      key,
+			wantSkip:     true,
+			wantRequests: 1,
+		},
+		{
+			name:         "skip-identical, identical object under a suffix",
+			strategy:     "skip-identical",
+			objects:      map[string]string{key: "other", "email/invoice-1.pdf": identical},
+			wantKey:      "email/invoice-1.pdf",
+			wantSkip:     true,
+			wantRequests: 2,
+		},
+		{
+			name:         "skip-identical, different object",
+			strategy:     "skip-identical",
+			objects:      map[string]string{key: "other"},
+			wantKey:      "email/invoice-1.pdf",
+			wantRequests: 2,
+		},
+		{name: "storage error", strategy: "skip-identical", fail: true, wantErr: "error checking if email/invoice.pdf exists", wantRequests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &stubStorage{objects: test.objects, fail: test.fail}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+
+			ew := &EmailWatcher{storageClient: storage.NewClient(server.URL)}
+			emailConfig := EmailConfig{Bucket: "bucket", KeyCollision: test.strategy}
+			gotKey, gotSkip, err := ew.resolveKeyCollision(context.Background(), emailConfig, key, localPath)
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if gotKey != test.wantKey || gotSkip != test.wantSkip {
+				t.Errorf("resolveKeyCollision() = %q, %v, want %q, %v", gotKey, gotSkip, test.wantKey, test.wantSkip)
+			}
+
+			if len(stub.requests) != test.wantRequests {
+				t.Errorf("requests = %q, want %d", stub.requests, test.wantRequests)
+			}
+			for _, request := range stub.requests {
+				if !strings.HasPrefix(request, http.MethodHead+" ") {
+					t.Errorf("unexpected request %q, only HEAD requests are allowed", request)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveKeyCollisionChecksInOrder(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "scan")
+	if err := ioutil.WriteFile(localPath, []byte("scan"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubStorage{objects: map[string]string{"scan": "a", "scan-1": "b"}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	ew := &EmailWatcher{storageClient: storage.NewClient(server.URL)}
+	key, _, err := ew.resolveKeyCollision(context.Background(), EmailConfig{Bucket: "bucket", KeyCollision: "suffix"}, "scan", localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "scan-2" {
+		t.Errorf("key = %q, want scan-2", key)
+	}
+	if want := []string{"HEAD scan", "HEAD scan-1", "HEAD scan-2"}; !reflect.DeepEqual(stub.requests, want) {
+		t.Errorf("requests = %q, want %q", stub.requests, want)
+	}
+}
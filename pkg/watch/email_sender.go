@@ -0,0 +1,123 @@
+package watch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"strings"
+)
+
+// RejectedError is returned for messages that failed a sender check. Rejected messages are handled like any other
+// failed message (see "on-failure").
+type RejectedError struct {
+	// "sender", "spf" or "dkim"
+	Check  string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("message rejected (%s): %s", e.Check, e.Reason)
+}
+
+// checkSender checks the sender (From address) of the message against the "deny-senders" and "allow-senders" lists,
+// then requires an SPF pass ("require-spf") in the Authentication-Results added by the receiving server, and a valid
+// DKIM signature aligned with the sender domain ("require-dkim").
+// Returns nil if the message is accepted.
+func (ew *EmailWatcher) checkSender(emailConfig EmailConfig, raw []byte, header mail.Header) *RejectedError {
+	if len(emailConfig.AllowSenders) == 0 && len(emailConfig.DenySenders) == 0 && !emailConfig.RequireSpf && !emailConfig.RequireDkim {
+		return nil
+	}
+
+	from, err := header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return &RejectedError{Check: "sender", Reason: "missing or invalid From header"}
+	}
+	sender := strings.ToLower(from[0].Address)
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+
+	if matchesSender(emailConfig.DenySenders, sender, domain) {
+		return &RejectedError{Check: "sender", Reason: fmt.Sprintf("sender %v is denied", sender)}
+	}
+	if len(emailConfig.AllowSenders) > 0 && !matchesSender(emailConfig.AllowSenders, sender, domain) {
+		return &RejectedError{Check: "sender", Reason: fmt.Sprintf("sender %v is not allowed", sender)}
+	}
+
+	if emailConfig.RequireSpf {
+		if result := spfResult(header, emailConfig.AuthservId); result != authres.ResultPass {
+			return &RejectedError{Check: "spf", Reason: fmt.Sprintf("spf result is %q", result)}
+		}
+	}
+
+	if emailConfig.RequireDkim {
+		if err := verifyDkim(raw, domain); err != nil {
+			return &RejectedError{Check: "dkim", Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// matchesSender returns true if the list contains the sender address, or its domain
+func matchesSender(list []string, sender string, domain string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimPrefix(entry, "@"))
+		if entry == sender || entry == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// spfResult returns the SPF result from the Authentication-Results header added by the receiving server: the header
+// with the "authserv-id" identifier, or the topmost header if not set. Headers added by other servers (eg. forged by
+// the sender) are ignored.
+func spfResult(header mail.Header, authservId string) authres.ResultValue {
+	for _, value := range header.Values("Authentication-Results") {
+		identifier, results, err := authres.Parse(value)
+		if authservId != "" && !strings.EqualFold(identifier, authservId) {
+			continue
+		}
+		if err != nil {
+			return authres.ResultPermError
+		}
+		for _, result := range results {
+			if spf, ok := result.(*authres.SPFResult); ok {
+				return spf.Value
+			}
+		}
+		return authres.ResultNone
+	}
+	return authres.ResultNone
+}
+
+// verifyDkim requires at least one valid DKIM signature from the sender domain (or a parent domain, ie. relaxed
+// alignment), so that a message signed by an unrelated domain is not accepted.
+func verifyDkim(raw []byte, domain string) error {
+	verifications, err := dkim.Verify(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	return dkimAligned(verifications, domain)
+}
+
+// dkimAligned returns nil if one of the signatures is valid, and aligned with the sender domain
+func dkimAligned(verifications []*dkim.Verification, domain string) error {
+	if len(verifications) == 0 {
+		return errors.New("message is not signed")
+	}
+
+	reasons := []string{}
+	for _, verification := range verifications {
+		signingDomain := strings.ToLower(verification.Domain)
+		if verification.Err != nil {
+			reasons = append(reasons, fmt.Sprintf("%v: %v", signingDomain, verification.Err))
+		} else if domain != signingDomain && !strings.HasSuffix(domain, "."+signingDomain) {
+			reasons = append(reasons, fmt.Sprintf("%v: not aligned with the sender domain %v", signingDomain, domain))
+		} else {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature (%v)", strings.Join(reasons, ", "))
+}
@@ -0,0 +1,111 @@
+package watch
+
+import (
+	"errors"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/dkim"
+	"strings"
+	"testing"
+)
+
+// testRawMessage builds a message with the header lines (without the trailing CRLF)
+func testRawMessage(headers ...string) []byte {
+	return []byte(strings.Join(headers, "\r\n") + "\r\nSubject: invoice\r\n\r\nbody\r\n")
+}
+
+func TestCheckSender(t *testing.T) {
+	const from = "From: Billing <Billing@Mail.Example.COM>"
+	const expiredSignature = "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=selector; h=from; bh=aGFzaA==; b=c2ln; x=1"
+	tests := []struct {
+		name       string
+		config     EmailConfig
+		raw        []byte
+		wantCheck  string
+		wantReason string
+	}{
+		{name: "no checks", raw: testRawMessage("To: scans@example.com")},
+		{name: "missing from", config: EmailConfig{DenySenders: []string{"example.org"}}, raw: testRawMessage("To: scans@example.com"), wantCheck: "sender", wantReason: "missing or invalid From header"},
+		{name: "denied domain", config: EmailConfig{DenySenders: []string{"mail.example.com"}}, raw: testRawMessage(from), wantCheck: "sender", wantReason: "sender billing@mail.example.com is denied"},
+		{name: "denied address", config: EmailConfig{AllowSenders: []string{"mail.example.com"}, DenySenders: []string{"billing@mail.example.com"}}, raw: testRawMessage(from), wantCheck: "sender", wantReason: "sender billing@mail.example.com is denied"},
+		{name: "allowed domain", config: EmailConfig{AllowSenders: []string{"@Mail.Example.com"}}, raw: testRawMessage(from)},
+		{name: "allowed address", config: EmailConfig{AllowSenders: []string{"other@example.com", "BILLING@mail.example.com"}}, raw: testRawMessage(from)},
+		{name: "parent domain is not allowed", config: EmailConfig{AllowSenders: []string{"example.com"}}, raw: testRawMessage(from), wantCheck: "sender", wantReason: "sender billing@mail.example.com is not allowed"},
+
+		{name: "spf pass", config: EmailConfig{RequireSpf: true}, raw: testRawMessage("Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=example.com", from)},
+		{name: "spf fail", config: EmailConfig{RequireSpf: true}, raw: testRawMessage("Authentication-Results: mx.example.net; spf=fail smtp.mailfrom=example.com", from), wantCheck: "spf", wantReason: `spf result is "fail"`},
+		{name: "spf missing", config: EmailConfig{RequireSpf: true}, raw: testRawMessage(from), wantCheck: "spf", wantReason: `spf result is "none"`},
+		{
+			// only the topmost header is added by the receiving server
+			name:       "spf pass added by the sender",
+			config:     EmailConfig{RequireSpf: true},
+			raw:        testRawMessage("Authentication-Results: mx.example.net; dkim=none", "Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=example.com", from),
+			wantCheck:  "spf",
+			wantReason: `spf result is "none"`,
+		},
+		{
+			name:   "spf pass from the authserv-id",
+			config: EmailConfig{RequireSpf: true, AuthservId: "mx.example.net"},
+			raw:    testRawMessage("Authentication-Results: filter.example.net; spf=none", "Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=example.com", from),
+		},
+		{
+			name:       "spf pass forged with another authserv-id",
+			config:     EmailConfig{RequireSpf: true, AuthservId: "mx.example.net"},
+			raw:        testRawMessage("Authentication-Results: forged.example.org; spf=pass smtp.mailfrom=example.com", from),
+			wantCheck:  "spf",
+			wantReason: `spf result is "none"`,
+		},
+
+		{name: "dkim unsigned", config: EmailConfig{RequireDkim: true}, raw: testRawMessage(from), wantCheck: "dkim", wantReason: "message is not signed"},
+		{name: "dkim expired", config: EmailConfig{RequireDkim: true}, raw: testRawMessage(expiredSignature, from), wantCheck: "dkim", wantReason: "no valid signature (example.com: dkim: signature has expired)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mr, err := mail.CreateReader(strings.NewReader(string(test.raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ew := newTestEmailWatcher(test.config)
+			rejected := ew.checkSender(test.config, test.raw, mr.Header)
+			if test.wantCheck == "" {
+				if rejected != nil {
+					t.Errorf("checkSender() = %v, want the message to be accepted", rejected)
+				}
+			} else if rejected == nil {
+				t.Errorf("checkSender() accepted the message, want a %v rejection", test.wantCheck)
+			} else if rejected.Check != test.wantCheck || rejected.Reason != test.wantReason {
+				t.Errorf("checkSender() = %v, want the %v check to reject it: %v", rejected, test.wantCheck, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestDkimAligned(t *testing.T) {
+	tests := []struct {
+		name          string
+		verifications []*dkim.Verification
+		wantErr       string
+	}{
+		{name: "unsigned", wantErr: "message is not signed"},
+		{name: "sender domain", verifications: []*dkim.Verification{{Domain: "mail.example.com"}}},
+		{name: "parent domain", verifications: []*dkim.Verification{{Domain: "Example.com"}}},
+		{name: "unrelated domain", verifications: []*dkim.Verification{{Domain: "example.org"}}, wantErr: "no valid signature (example.org: not aligned with the sender domain mail.example.com)"},
+		{name: "suffix of the domain", verifications: []*dkim.Verification{{Domain: "ample.com"}}, wantErr: "no valid signature (ample.com: not aligned with the sender domain mail.example.com)"},
+		{name: "invalid signature", verifications: []*dkim.Verification{{Domain: "example.com", Err: errors.New("bad signature")}}, wantErr: "no valid signature (example.com: bad signature)"},
+		{
+			name: "one valid signature",
+			verifications: []*dkim.Verification{
+				{Domain: "example.org"},
+				{Domain: "example.com", Err: errors.New("bad signature")},
+				{Domain: "mail.example.com"},
+			},
+		},
+	}
+	for _, test := range tests {
+		err := dkimAligned(test.verifications, "mail.example.com")
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%v: dkimAligned() = %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%v: dkimAligned() = %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testImapUser wraps the users of the memory backend, so that their mailboxes support MOVE
+type testImapUser struct {
+	backend.User
+}
+
+func (u testImapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return testImapMailbox{mbox}, nil
+}
+
+type testImapMailbox struct {
+	backend.Mailbox
+}
+
+func (m testImapMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if !uid {
+		return errors.New("only UID MOVE is supported")
+	}
+	if err := m.CopyMessages(uid, seqset, dest); err != nil {
+		return err
+	}
+	if err := m.UpdateMessagesFlags(uid, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return expungeMessages(m.Mailbox, seqset)
+}
+
+// expungeMessages only expunges the deleted messages in the set of UIDs. The memory backend expunges every deleted
+// message, so the others are undeleted until it's done.
+func expungeMessages(mbox backend.Mailbox, uids *imap.SeqSet) error {
+	deleted, err := mbox.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+	if err != nil {
+		return err
+	}
+	others := new(imap.SeqSet)
+	for _, uid := range deleted {
+		if !uids.Contains(uid) {
+			others.AddNum(uid)
+		}
+	}
+	if others.Empty() {
+		return mbox.Expunge()
+	}
+	if err := mbox.UpdateMessagesFlags(true, others, imap.RemoveFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	if err := mbox.Expunge(); err != nil {
+		return err
+	}
+	return mbox.UpdateMessagesFlags(true, others, imap.AddFlags, []string{imap.DeletedFlag})
+}
+
+// testUidPlus is a server extension, adding UID EXPUNGE (UIDPLUS)
+type testUidPlus struct{}
+
+func (testUidPlus) Capabilities(c server.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (testUidPlus) Command(name string) server.HandlerFactory {
+	if name != "EXPUNGE" {
+		return nil
+	}
+	return func() server.Handler { return &testUidExpunge{} }
+}
+
+type testUidExpunge struct {
+	server.Expunge
+	uids *imap.SeqSet
+}
+
+func (cmd *testUidExpunge) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	seqset, ok := fields[0].(string)
+	if !ok {
+		return errors.New("invalid UID EXPUNGE sequence set")
+	}
+	var err error
+	cmd.uids, err = imap.ParseSeqSet(seqset)
+	return err
+}
+
+func (cmd *testUidExpunge) UidHandle(conn server.Conn) error {
+	if conn.Context().Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	return expungeMessages(conn.Context().Mailbox, cmd.uids)
+}
+
+type testImapBackend struct {
+	*memory.Backend
+}
+
+func (b testImapBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	u, err := b.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return testImapUser{u}, nil
+}
+
+// testMessage is a message in the INBOX of the test server
+type testMessage struct {
+	uid   uint32
+	flags []string
+}
+
+// startTestImap serves an INBOX with the messages (user "username", password "password") on localhost, and returns a
+// client logged in to it
+func startTestImap(t *testing.T, messages []testMessage, extensions ...server.Extension) *client.Client {
+	be := memory.New()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := mbox.(*memory.Mailbox)
+	inbox.Messages = nil
+	for _, message := range messages {
+		body := []byte("Subject: message " + strings.Repeat("x", int(message.uid)) + "\r\n\r\nbody")
+		inbox.Messages = append(inbox.Messages, &memory.Message{Uid: message.uid, Flags: message.flags, Size: uint32(len(body)), Body: body})
+	}
+
+	s := server.New(testImapBackend{be})
+	s.AllowInsecureAuth = true
+	s.Enable(extensions...)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// listMessages returns the flags of the messages in the folder, by UID
+func listMessages(t *testing.T, c *client.Client, folder string) map[uint32][]string {
+	t.Helper()
+	if _, err := c.Select(folder, true); err != nil {
+		t.Fatal(err)
+	}
+	seqset, _ := imap.ParseSeqSet("1:*")
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, messages)
+	}()
+	flags := map[uint32][]string{}
+	for msg := range messages {
+		flags[msg.Uid] = msg.Flags
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return flags
+}
+
+func newTestEmailWatcher(emailConfig EmailConfig) *EmailWatcher {
+	return &EmailWatcher{logger: logrus.NewEntry(logrus.New()), config: emailConfig, unexpunged: new(imap.SeqSet)}
+}
+
+func TestEmailWatcherReady(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer api.Close()
+
+	ew := newTestEmailWatcher(EmailConfig{ImapFolder: "INBOX"})
+	ew.storageClient = storage.NewClient(api.URL)
+	if err := ew.Ready(); err == nil || err.Error() != "not connected to the imap server" {
+		t.Errorf("Ready() before connecting = %v", err)
+	}
+
+	c := startTestImap(t, nil)
+	ew.setSession(c, nil)
+	if err := ew.Ready(); err != nil {
+		t.Errorf("Ready() = %v", err)
+	}
+
+	// the folder is selected by each check
+	ew.config.ImapFolder = "Missing"
+	ew.batchProcessMessages(context.Background(), context.Background(), c, nil)
+	if err := ew.Ready(); err == nil || !strings.HasPrefix(err.Error(), "imap session unavailable: failed to select Missing") {
+		t.Errorf("Ready() after a failed select = %v", err)
+	}
+	ew.config.ImapFolder = "INBOX"
+	ew.batchProcessMessages(context.Background(), context.Background(), c, nil)
+	if err := ew.Ready(); err != nil {
+		t.Errorf("Ready() after a successful select = %v", err)
+	}
+
+	if err := c.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Ready(); err == nil || err.Error() != "imap session lost" {
+		t.Errorf("Ready() after logging out = %v", err)
+	}
+
+	api.Close()
+	ew.setSession(startTestImap(t, nil), nil)
+	if err := ew.Ready(); err == nil || !strings.HasPrefix(err.Error(), "storage api unavailable") {
+		t.Errorf("Ready() without the storage api = %v", err)
+	}
+}
+
+// describeMessages lists the UIDs and flags of the messages, eg. "1 \\Deleted". Keywords are case-insensitive, the
+// test server returns them in lower case.
+func describeMessages(messages map[uint32][]string) []string {
+	described := []string{}
+	for uid, flags := range messages {
+		described = append(described, strings.TrimSpace(fmt.Sprintf("%d %v", uid, strings.Join(flags, " "))))
+	}
+	sort.Strings(described)
+	return described
+}
+
+func TestPostProcessMessages(t *testing.T) {
+	// message 1 was processed, 2 failed, and 3 is another message in the mailbox
+	deletedByOtherClient := []testMessage{{uid: 1}, {uid: 2}, {uid: 3, flags: []string{imap.DeletedFlag}}}
+	tests := []struct {
+		name          string
+		config        EmailConfig
+		uidPlus       bool
+		messages      []testMessage
+		wantInbox     []string
+		wantProcessed int
+		wantFailed    int
+	}{
+		{
+			name:       "delete",
+			config:     EmailConfig{PostProcess: "delete", OnFailure: "move"},
+			uidPlus:    true,
+			messages:   deletedByOtherClient,
+			wantInbox:  []string{`3 \Deleted`},
+			wantFailed: 1,
+		},
+		{
+			name:       "delete without UIDPLUS",
+			config:     EmailConfig{PostProcess: "delete", OnFailure: "move"},
+			messages:   []testMessage{{uid: 1}, {uid: 2}, {uid: 3}},
+			wantInbox:  []string{"3"},
+			wantFailed: 1,
+		},
+		{
+			// EXPUNGE would remove message 3 as well, so the processed message is left marked as deleted
+			name:       "delete without UIDPLUS, with a message deleted by another client",
+			config:     EmailConfig{PostProcess: "delete", OnFailure: "move"},
+			messages:   deletedByOtherClient,
+			wantInbox:  []string{`1 \Deleted`, `3 \Deleted`},
+			wantFailed: 1,
+		},
+		{
+			name:          "move",
+			config:        EmailConfig{PostProcess: "move", OnFailure: "move"},
+			messages:      deletedByOtherClient,
+			wantInbox:     []string{`3 \Deleted`},
+			wantProcessed: 1,
+			wantFailed:    1,
+		},
+		{
+			name:       "flag",
+			config:     EmailConfig{PostProcess: "flag", OnFailure: "move"},
+			messages:   deletedByOtherClient,
+			wantInbox:  []string{"1 $lodestoneprocessed", `3 \Deleted`},
+			wantFailed: 1,
+		},
+		{
+			name:      "flag, keep failed messages",
+			config:    EmailConfig{PostProcess: "flag", OnFailure: "keep"},
+			messages:  deletedByOtherClient,
+			wantInbox: []string{"1 $lodestoneprocessed", "2", `3 \Deleted`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var extensions []server.Extension
+			if test.uidPlus {
+				extensions = append(extensions, testUidPlus{})
+			}
+			c := startTestImap(t, test.messages, extensions...)
+			if _, err := c.Select("INBOX", false); err != nil {
+				t.Fatal(err)
+			}
+
+			test.config.ImapFolder = "INBOX"
+			test.config.ProcessedFolder = "Processed"
+			test.config.ProcessedFlag = "$LodestoneProcessed"
+			test.config.FailedFolder = "Failed"
+			ew := newTestEmailWatcher(test.config)
+			processed, _ := imap.ParseSeqSet("1")
+			failed, _ := imap.ParseSeqSet("2")
+			if err := ew.postProcessMessages(c, processed, failed); err != nil {
+				t.Fatal(err)
+			}
+
+			if inbox := describeMessages(listMessages(t, c, "INBOX")); !reflect.DeepEqual(inbox, test.wantInbox) {
+				t.Errorf("INBOX = %q, want %q", inbox, test.wantInbox)
+			}
+			for folder, want := range map[string]int{"Processed": test.wantProcessed, "Failed": test.wantFailed} {
+				if want == 0 {
+					continue
+				}
+				if got := len(listMessages(t, c, folder)); got != want {
+					t.Errorf("%v has %d messages, want %d", folder, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteMessagesWithoutUidPlusExpungesLater(t *testing.T) {
+	c := startTestImap(t, []testMessage{{uid: 1}, {uid: 2}, {uid: 3, flags: []string{imap.DeletedFlag}}})
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	ew := newTestEmailWatcher(EmailConfig{ImapFolder: "INBOX", PostProcess: "delete"})
+
+	first, _ := imap.ParseSeqSet("1")
+	if err := ew.deleteMessages(c, first); err != nil {
+		t.Fatal(err)
+	}
+	if inbox, want := describeMessages(listMessages(t, c, "INBOX")), []string{`1 \Deleted`, "2", `3 \Deleted`}; !reflect.DeepEqual(inbox, want) {
+		t.Errorf("INBOX = %q, want %q", inbox, want)
+	}
+
+	// once the other client restored its message, the next delete expunges both of our messages
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := imap.ParseSeqSet("3")
+	if err := c.UidStore(other, imap.FormatFlagsOp(imap.RemoveFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := imap.ParseSeqSet("2")
+	if err := ew.deleteMessages(c, second); err != nil {
+		t.Fatal(err)
+	}
+	if inbox, want := describeMessages(listMessages(t, c, "INBOX")), []string{"3"}; !reflect.DeepEqual(inbox, want) {
+		t.Errorf("INBOX = %q, want %q", inbox, want)
+	}
+}
@@ -1,127 +1,383 @@
 package watch
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/analogj/fsnotify"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
 	"github.com/analogj/lodestone-publisher/pkg/model"
 	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"github.com/analogj/lodestone-publisher/pkg/storage"
+	"github.com/analogj/lodestone-publisher/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
 )
 
+func init() {
+	Register("fs", func() Interface { return new(FsWatcher) })
+}
+
 type FsWatcher struct {
+	statusTracker
+
 	logger  *logrus.Entry
-	watcher *fsnotify.Watcher
+	config  FsConfig
+	watcher fsEventWatcher
+	polling bool
+	index   *fileIndex
+	ignore  *ignoreRules
+	pool    *publishPool
+
+	// directories that could not be watched because the inotify watch limit was reached, they are periodically
+	// rescanned instead
+	unwatchedDirs map[string]bool
+
+	// when mirroring, files are uploaded to (and deleted from) the storage api before the event is published
+	storageClient *storage.Client
+
+	// config reloads are applied on the event loop, which owns the index
+	reloads chan fsReload
+	stopped chan bool
+}
+
+type fsReload struct {
+	config FsConfig
+	result chan error
 }
 
-func (fs *FsWatcher) Start(logger *logrus.Entry, notifyClient notify.Interface, config map[string]string) {
+// Validate checks the config, see ParseFsConfig
+func (fs *FsWatcher) Validate(config map[string]string) error {
+	_, err := ParseFsConfig(config)
+	return err
+}
+
+// Start watches a single directory tree, publishing events for created & removed files. It blocks until the watcher
+// fails (returning the error), or the context is cancelled. On shutdown, queued events are given "shutdown-timeout"
+// seconds to be published, and the file index is saved if a "state-dir" is configured.
+func (fs *FsWatcher) Start(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface, config map[string]string) error {
 	fs.logger = logger
-	watcher, err := fsnotify.NewWatcher()
+	fs.setState(StateStarting, nil)
+	fsConfig, err := ParseFsConfig(config)
 	if err != nil {
-		fs.logger.Fatal(err)
+		return err
+	}
+	fs.config = fsConfig
+	if _, err := os.Stat(fs.config.Dir); err != nil {
+		return err
+	}
+	fs.index = newFileIndex()
+	fs.unwatchedDirs = map[string]bool{}
+	fs.ignore = newIgnoreRules(fs.config.Dir, fs.config.Include, fs.config.Exclude)
+	if fs.config.Mirror {
+		fs.logger.Infof("Mirroring files to storage api: %v", fs.config.ApiEndpoint)
+		fs.storageClient = storage.NewClient(fs.config.ApiEndpoint)
+	}
+
+	fs.pool = newPublishPool(fs.logger, fs.config.Dir, fs.config.Workers, fs.config.QueueSize)
+	stateFile := stateFilePath(fs.config)
+	indexReady := false
+	defer func() {
+		fs.logger.Infoln("Waiting for queued events to be published")
+		if !fs.pool.Close(fs.config.ShutdownTimeout) {
+			fs.logger.Warnf("Shutdown timeout expired, abandoned events for %d files", len(fs.pool.Pending()))
+		} else if pending := fs.pool.Pending(); len(pending) > 0 {
+			fs.logger.Warnf("Events for %d files failed and were not retried successfully", len(pending))
+		}
+		if stateFile != "" && indexReady {
+			// unpublished (or failed) events are published again on the next start
+			err := fs.index.SaveState(stateFile, fs.config.Dir, fs.pool.Pending())
+			if !fs.CheckErr(err) {
+				fs.logger.Infof("Saved state: %v", stateFile)
+			}
+		}
+		fs.setState(StateStopped, nil)
+	}()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	fs.polling = fs.usePolling()
+	if fs.polling {
+		fs.logger.Infof("Polling for filesystem changes every %v", fs.config.PollInterval)
+
+		watcher := newPollWatcher(fs.logger, fs.config.Dir, fs.ignore, fs.config.PollInterval)
+		fs.watcher = watcher
+		events = watcher.Events
+		errs = watcher.Errors
+	} else {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		fs.watcher = watcher
+		events = watcher.Events
+		errs = watcher.Errors
 	}
-	fs.watcher = watcher
 	defer fs.watcher.Close()
 
-	// starting at the root of the specified directory, walk each file/sub-directory searching for
-	// new directories
-	if err := filepath.Walk(config["dir"], fs.AddWatchDir); err != nil {
-		fmt.Println("ERROR", err)
+	restored := false
+	if stateFile != "" {
+		restored, err = fs.index.LoadState(stateFile)
+		if err != nil {
+			fs.logger.Warnf("Ignoring unreadable state file %v: %v", stateFile, err)
+			fs.index = newFileIndex()
+		}
 	}
 
-	fmt.Println("Start watching for filesystem events")
-	done := make(chan bool)
+	if restored {
+		// publish the changes that were made while we were not running
+		recovered := fs.rescan(notifyClient, fs.config.Dir)
+		fs.logger.Infof("Restored state from %v, recovered %d events", stateFile, recovered)
+	} else if err := filepath.Walk(fs.config.Dir, fs.AddWatchDir); err != nil {
+		// starting at the root of the specified directory, walk each file/sub-directory searching for
+		// new directories
+		return err
+	}
+	indexReady = true
+	fs.reloads = make(chan fsReload)
+	fs.stopped = make(chan bool)
+	fs.setLivenessTimeout(fsLivenessTimeout)
+	fs.setState(StateRunning, nil)
+
+	fs.logger.Infoln("Start watching for filesystem events")
+	done := make(chan error)
+
+	unwatchedRescanTicker := time.NewTicker(unwatchedRescanInterval)
+	defer unwatchedRescanTicker.Stop()
+	retryTicker := time.NewTicker(minRetryDelay)
+	defer retryTicker.Stop()
 
 	go func() {
+		defer close(fs.stopped)
+		defer metrics.WatchedDirectories.DeleteLabelValues(fs.config.Dir)
 		for {
+			fs.touch()
+			metrics.WatchedDirectories.WithLabelValues(fs.config.Dir).Set(float64(fs.index.DirCount() - len(fs.unwatchedDirs)))
 			select {
 
+			//stop accepting new events
+			case <-ctx.Done():
+				fs.logger.Infoln("Stop watching for filesystem events")
+				fs.setState(StateStopping, nil)
+				done <- nil
+				return
+
 			//watch for events
-			case event, ok := <-watcher.Events:
+			case event, ok := <-events:
 				if !ok {
 					fs.logger.Warnln("FAILED event:", event)
+					done <- fmt.Errorf("event channel closed")
 					return
 				}
-				fs.logger.Debugln("event:", event)
-
-				// PSEUDO CODE
-				// check if event is "add" or "delete"
-				// if event is "add" and is a file:
-				// 	 generate an event and publish
-				// if event is "add" and is a folder:
-				// 	 add watcher
-				// if event is "remove" and is a file or folder:
-				//   generate an event and publish
-				//   remove watcher (in-case this is a folder)
-
-				s3EventName := ""
-				if (event.Op&fsnotify.Create == fsnotify.Create) || (event.Op&fsnotify.CloseWrite == fsnotify.CloseWrite) {
-					fs.logger.Infoln("Processing create event: ", event)
-
-					s3EventName = "s3:ObjectCreated:Put"
-
-					//get event file/folder data.
-					eventPathInfo, err := os.Stat(event.Name)
-					if fs.CheckErr(err) {
-						break
-					}
-
-					switch mode := eventPathInfo.Mode(); {
-					case mode.IsDir():
-						// newly added folder
-						err := fs.AddWatchDir(event.Name, eventPathInfo, nil)
-						fs.CheckErr(err)
-
-					case mode.IsRegular():
-						// newly added file.
-						s3Event, err := GenerateS3Event(s3EventName, event, config)
-						fs.CheckErr(err)
-						if err == nil {
-							err := notifyClient.Publish(s3Event)
-							fs.CheckErr(err)
-						}
-					}
-
-				} else if event.Op&fsnotify.Remove == fsnotify.Remove {
-					fs.logger.Infoln("Processing delete event: ", event)
-
-					s3EventName = "s3:ObjectRemoved:Delete"
-
-					s3Event, err := GenerateS3Event(s3EventName, event, config)
-					fs.CheckErr(err)
-					if err == nil {
-						err := notifyClient.Publish(s3Event)
-						fs.CheckErr(err)
-					}
-
-					fs.RemoveWatchDir(event.Name, nil, nil)
-				} else {
-					fs.logger.Infoln("Ignoring event: ", event)
-				}
+				fs.handleEvent(notifyClient, event)
 
 			//watch for errors
-			case err, ok := <-watcher.Errors:
+			case err, ok := <-errs:
 				if !ok {
 					fs.logger.Errorln("failed error", err)
+					done <- fmt.Errorf("error channel closed")
 					return
 				}
 				fs.logger.Errorln("error:", err)
+				if err == fsnotify.ErrEventOverflow {
+					// the kernel dropped events, we no longer know which files changed so reconcile the whole tree
+					recovered := fs.rescan(notifyClient, fs.config.Dir)
+					fs.logger.Warnf("Recovered %d events after inotify queue overflow", recovered)
+				}
+
+			case <-unwatchedRescanTicker.C:
+				fs.rescanUnwatchedDirs(notifyClient)
+
+			case <-retryTicker.C:
+				fs.pool.Retry()
+				// removed files are only kept in the index (for the saved state) until their removal was published
+				fs.index.ForgetRemoved(fs.pool.Pending())
+
+			case reload := <-fs.reloads:
+				fs.logger.Infof("Reloading include/exclude globs: include %v, exclude %v", reload.config.Include, reload.config.Exclude)
+				fs.ignore.SetGlobs(reload.config.Include, reload.config.Exclude)
+				fs.reconcileIgnored(fs.config.Dir)
+				reload.result <- nil
 			}
 		}
 	}()
 
-	<-done
+	return <-done
+}
+
+// handleEvent updates the index & watches for a filesystem event, and publishes events for the affected files
+func (fs *FsWatcher) handleEvent(notifyClient notify.Interface, event fsnotify.Event) {
+	fs.logger.Debugln("event:", event)
+
+	// PSEUDO CODE
+	// check if event is "add" or "delete"
+	// if event is "add" and is a file:
+	// 	 generate an event and publish
+	// if event is "add" and is a folder:
+	// 	 add watcher, generate an event for every file already in the folder and publish (when polling, the
+	// 	 poller reports those files itself)
+	// if event is "remove" (or "rename") and is a file:
+	//   generate an event and publish
+	// if event is "remove" (or "rename") and is a folder:
+	//   generate an event for every file that lived in the folder and publish
+	//   remove watcher
+
+	if filepath.Base(event.Name) == IgnoreFileName {
+		// ignore rules changed, (un)watch the affected directories
+		fs.reloadIgnoreFile(filepath.Dir(event.Name))
+		return
+	}
+
+	s3EventName := ""
+	if (event.Op&fsnotify.Create == fsnotify.Create) || (event.Op&fsnotify.CloseWrite == fsnotify.CloseWrite) {
+		fs.logger.Infoln("Processing create event: ", event)
+
+		s3EventName = "s3:ObjectCreated:Put"
+
+		//get event file/folder data.
+		eventPathInfo, err := os.Stat(event.Name)
+		if fs.CheckErr(err) {
+			return
+		}
+		if fs.ignore.IsIgnored(event.Name, eventPathInfo.IsDir()) {
+			fs.logger.Debugln("Skipping ignored path: ", event.Name)
+			return
+		}
+
+		switch mode := eventPathInfo.Mode(); {
+		case mode.IsDir():
+			if fs.polling {
+				// the poller reports the files inside the new folder itself, once they are no longer being
+				// written to. Only the folder is indexed (its sub folders get their own events).
+				fs.CheckErr(fs.AddWatchDir(event.Name, eventPathInfo, nil))
+			} else {
+				// newly added (or moved in) folder, the files already inside it are not reported by the OS,
+				// so walk it to watch, index and publish them
+				fs.rescan(notifyClient, event.Name)
+			}
+
+		case mode.IsRegular():
+			// newly added file.
+			fs.index.AddFile(event.Name, eventPathInfo)
+			fs.publishEvent(notifyClient, s3EventName, event)
+		}
+
+	} else if (event.Op&fsnotify.Remove == fsnotify.Remove) || (event.Op&fsnotify.Rename == fsnotify.Rename) {
+		// a rename is reported for the old path, the new path (if it is still in the tree) gets a create
+		fs.logger.Infoln("Processing delete event: ", event)
+
+		s3EventName = "s3:ObjectRemoved:Delete"
+
+		if fs.index.IsDir(event.Name) {
+			// removed folder, the OS will not tell us about the files that were inside, so use the index.
+			// The watches of a moved folder follow it, so they are removed as well.
+			watchedDirs := fs.index.Dirs(event.Name)
+			removedFiles := fs.index.RemoveDir(event.Name)
+			fs.logger.Infof("Removed directory contained %d files", len(removedFiles))
+			for _, removedFile := range removedFiles {
+				fs.publishEvent(notifyClient, s3EventName, fsnotify.Event{Name: removedFile, Op: fsnotify.Remove})
+			}
+			for _, watchedDir := range watchedDirs {
+				fs.RemoveWatchDir(watchedDir, nil, nil)
+				delete(fs.unwatchedDirs, watchedDir)
+			}
+		} else if fs.index.RemoveFile(event.Name) || !fs.ignore.IsIgnored(event.Name, false) {
+			fs.publishEvent(notifyClient, s3EventName, event)
+		}
+	} else {
+		fs.logger.Infoln("Ignoring event: ", event)
+	}
+}
+
+// Reload applies changed include/exclude globs in place, keeping the index & watches. Any other change requires a
+// restart.
+func (fs *FsWatcher) Reload(config map[string]string) error {
+	fsConfig, err := ParseFsConfig(config)
+	if err != nil {
+		return err
+	}
+	if fs.Status().State != StateRunning {
+		return ErrRestartRequired
+	}
+
+	// fs.config is shared with the workers, so it is never modified. The globs live in the ignore rules.
+	unchanged := fsConfig
+	unchanged.Include = fs.config.Include
+	unchanged.Exclude = fs.config.Exclude
+	if !reflect.DeepEqual(unchanged, fs.config) {
+		return ErrRestartRequired
+	}
+
+	reload := fsReload{config: fsConfig, result: make(chan error, 1)}
+	select {
+	case fs.reloads <- reload:
+		return <-reload.result
+	case <-fs.stopped:
+		return ErrRestartRequired
+	}
+}
+
+// Ready checks that the storage api is reachable, when mirroring
+func (fs *FsWatcher) Ready() error {
+	if fs.storageClient == nil {
+		return nil
+	}
+	if err := fs.storageClient.Ping(); err != nil {
+		return fmt.Errorf("storage api unavailable: %v", err)
+	}
+	return nil
 }
 
 // watchDir gets run as a walk func, searching for directories to add watchers to
 func (fs *FsWatcher) AddWatchDir(path string, fi os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+
+	// ignored directories are not watched (or descended into)
+	if fs.ignore.IsIgnored(path, fi.Mode().IsDir()) {
+		if fi.Mode().IsDir() {
+			fs.logger.Infof("Skipping ignored directory: %v", path)
+			return filepath.SkipDir
+		}
+		return nil
+	}
 
 	// since fsnotify can watch all the files in a directory, watchers only need
 	// to be added to each nested directory
 	if fi.Mode().IsDir() {
+		// rules in this directory's ignore file apply to its children
+		if err := fs.ignore.LoadIgnoreFile(path); err != nil {
+			return err
+		}
+		path = filepath.Clean(path)
+		if fs.index.IsDir(path) && !fs.unwatchedDirs[path] {
+			// already watching
+			return nil
+		}
 		fs.logger.Infof("Watching new directory: %v", path)
-		return fs.watcher.Add(path)
+		fs.index.AddDir(path)
+		if err := fs.watcher.Add(path); errors.Is(err, syscall.ENOSPC) {
+			// keep walking, so that the files are still indexed. The directory will be picked up by periodic rescans
+			fs.logger.Warnf("Unable to watch directory %v, the inotify watch limit has been reached (see fs.inotify.max_user_watches). Rescanning every %v instead", path, unwatchedRescanInterval)
+			fs.unwatchedDirs[path] = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		delete(fs.unwatchedDirs, path)
+		return nil
+	} else if fi.Mode().IsRegular() {
+		// keep track of existing files, so we can generate events for them if their parent directory is removed
+		fs.index.AddFile(path, fi)
 	}
 
 	return nil
@@ -132,17 +388,148 @@ func (fs *FsWatcher) RemoveWatchDir(path string, fi os.FileInfo, err error) erro
 	return fs.watcher.Remove(path)
 }
 
+// usePolling determines if the tree should be polled rather than watched with inotify.
+// In "auto" mode (the default) polling is used when the directory lives on a network or FUSE filesystem.
+func (fs *FsWatcher) usePolling() bool {
+	switch fs.config.WatchMode {
+	case "poll":
+		return true
+	case "inotify":
+		return false
+	default:
+		if fsType := remoteMountType(fs.config.Dir); fsType != "" {
+			fs.logger.Infof("Directory is on a %s mount, inotify events are unreliable. Falling back to polling", fsType)
+			return true
+		}
+		return false
+	}
+}
+
+// reloadIgnoreFile re-reads the ignore file in a directory, stops watching directories that are now ignored, and
+// starts watching directories that no longer are.
+// Files that become (un)ignored are silently dropped from (or added to) the index, no events are generated for them.
+func (fs *FsWatcher) reloadIgnoreFile(dir string) {
+	fs.logger.Infof("Reloading ignore rules: %v", filepath.Join(dir, IgnoreFileName))
+	if fs.CheckErr(fs.ignore.LoadIgnoreFile(dir)) {
+		return
+	}
+	fs.reconcileIgnored(dir)
+}
+
+// reconcileIgnored applies changed ignore rules to the index & watches below the directory
+func (fs *FsWatcher) reconcileIgnored(dir string) {
+	for _, watchedDir := range fs.index.Dirs(dir) {
+		if fs.index.IsDir(watchedDir) && fs.ignore.IsIgnored(watchedDir, true) {
+			for _, nestedDir := range fs.index.Dirs(watchedDir) {
+				fs.CheckErr(fs.RemoveWatchDir(nestedDir, nil, nil))
+			}
+			fs.index.RemoveDir(watchedDir)
+		}
+	}
+	for _, file := range fs.index.Files(dir) {
+		if fs.ignore.IsIgnored(file, false) {
+			fs.index.RemoveFile(file)
+		}
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		fs.CheckErr(filepath.Walk(dir, fs.AddWatchDir))
+	}
+}
+
 // Helpers
 
-func GenerateS3Event(s3EventName string, fsevent fsnotify.Event, config map[string]string) (model.S3Event, error) {
+// splitList converts a comma separated config value into a list, skipping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// publishEvent queues the event on the worker pool, so hashing, uploading & publishing happen off the event loop.
+// Events for the same path are processed in order, and failed events (eg. a failed upload) are retried with backoff.
+// Each event is traced from detection until it was published (or first failed).
+func (fs *FsWatcher) publishEvent(notifyClient notify.Interface, s3EventName string, fsevent fsnotify.Event) {
+	metrics.EventsSeen.WithLabelValues(fs.config.Source, fs.config.Bucket, s3EventName).Inc()
+	ctx, span := tracing.Tracer().Start(context.Background(), "fs.event", trace.WithAttributes(
+		attribute.String("fs.path", fsevent.Name),
+		attribute.String("s3.bucket", fs.config.Bucket),
+		attribute.String("s3.event", s3EventName),
+	))
+	fs.pool.Submit(fsevent.Name, func() error {
+		err := fs.processEvent(ctx, notifyClient, s3EventName, fsevent)
+		tracing.End(span, err)
+		if fs.CheckErr(err) {
+			// the pool retries the event, until it succeeds or is replaced by a newer event for the file
+			metrics.EventsFailed.WithLabelValues(fs.config.Source, fs.config.Bucket, s3EventName).Inc()
+			return err
+		}
+		metrics.EventsPublished.WithLabelValues(fs.config.Source, fs.config.Bucket, s3EventName).Inc()
+		return nil
+	})
+}
+
+func (fs *FsWatcher) processEvent(ctx context.Context, notifyClient notify.Interface, s3EventName string, fsevent fsnotify.Event) error {
+	if fs.storageClient != nil {
+		// in mirror mode, the event is held back unless the storage api has the same view of the file
+		if err := fs.mirrorFile(ctx, s3EventName, fsevent.Name); err != nil {
+			return err
+		}
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "fs.hash")
+	s3Event, err := GenerateS3Event(s3EventName, fsevent, fs.config)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	return notifyClient.Publish(ctx, s3Event)
+}
+
+// mirrorFile uploads created files to the storage api, and deletes removed files
+func (fs *FsWatcher) mirrorFile(ctx context.Context, s3EventName string, filePath string) error {
+	key, err := ObjectKey(filePath, fs.config)
+	if err != nil {
+		return err
+	}
+
+	if s3EventName == "s3:ObjectRemoved:Delete" {
+		fs.logger.Infof("Deleting file from storage: %v", key)
+		return fs.storageClient.Delete(ctx, fs.config.Bucket, key)
+	}
+	fs.logger.Infof("Uploading file to storage: %v", key)
+	return fs.storageClient.Upload(ctx, fs.config.Bucket, key, filePath)
+}
 
-	relPath, err := filepath.Rel(config["dir"], fsevent.Name)
+// ObjectKey is the path relative to the watched directory, nested under the optional "prefix"
+func ObjectKey(filePath string, config FsConfig) (string, error) {
+	relPath, err := filepath.Rel(config.Dir, filePath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(config.Prefix, filepath.ToSlash(relPath)), nil
+}
+
+// GenerateS3Event creates the event for a file. The event source defaults to "fs" unless a "source" name is
+// configured.
+func GenerateS3Event(s3EventName string, fsevent fsnotify.Event, config FsConfig) (model.S3Event, error) {
+
+	key, err := ObjectKey(fsevent.Name, config)
 	if err != nil {
 		return model.S3Event{}, err
 	}
 
+	source := config.Source
+	if source == "" {
+		source = "fs"
+	}
+
 	s3EventPayload := model.S3Event{}
-	err = s3EventPayload.Create("fs", s3EventName, config["bucket"], relPath, fsevent.Name)
+	err = s3EventPayload.Create(source, s3EventName, config.Bucket, key, fsevent.Name)
 	return s3EventPayload, err
 }
 
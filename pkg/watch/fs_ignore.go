@@ -0,0 +1,228 @@
+package watch
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// IgnoreFileName is the name of the gitignore-style file that can be placed at any level of the watched tree.
+// Patterns are relative to the directory containing the file.
+const IgnoreFileName = ".lodestoneignore"
+
+// files that are never documents (OS metadata, office lock files, partial downloads, sync tool state)
+var defaultIgnorePatterns = []string{
+	IgnoreFileName,
+	".DS_Store",
+	"Thumbs.db",
+	"desktop.ini",
+	"~$*",
+	"*.part",
+	"*.crdownload",
+	".sync/",
+}
+
+type ignorePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// parseIgnorePattern converts a single line of a .lodestoneignore file (or an --include/--exclude glob) into a
+// pattern, following gitignore syntax:
+//   - blank lines and lines starting with # are skipped
+//   - a leading ! negates the pattern
+//   - a trailing / only matches directories
+//   - a pattern containing a / is anchored to the base directory, otherwise it matches at any depth
+//   - ** matches zero or more directories
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignorePattern{}, false
+	}
+
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// escaped leading # or !
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return ignorePattern{}, false
+	}
+
+	pattern.segments = strings.Split(line, "/")
+	if !anchored {
+		pattern.segments = append([]string{"**"}, pattern.segments...)
+	}
+	return pattern, true
+}
+
+// match checks the pattern against a slash separated path, relative to the pattern's base directory.
+func (p ignorePattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(p.segments, strings.Split(relPath, "/"))
+}
+
+func matchSegments(patternSegments []string, pathSegments []string) bool {
+	for len(patternSegments) > 0 {
+		if patternSegments[0] == "**" {
+			for i := 0; i <= len(pathSegments); i++ {
+				if matchSegments(patternSegments[1:], pathSegments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(pathSegments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(patternSegments[0], pathSegments[0]); !ok {
+			return false
+		}
+		patternSegments = patternSegments[1:]
+		pathSegments = pathSegments[1:]
+	}
+	return len(pathSegments) == 0
+}
+
+// ignoreRules decides which files & directories under the watched root should be skipped.
+// Rules are evaluated in order (built-in defaults, --exclude globs, then .lodestoneignore files from the root
+// downwards) and the last matching pattern wins, just like git.
+type ignoreRules struct {
+	mu          sync.RWMutex
+	root        string
+	includes    []ignorePattern
+	excludes    []ignorePattern
+	ignoreFiles map[string][]ignorePattern
+}
+
+func newIgnoreRules(root string, includes []string, excludes []string) *ignoreRules {
+	rules := &ignoreRules{
+		root:        filepath.Clean(root),
+		ignoreFiles: map[string][]ignorePattern{},
+	}
+	rules.SetGlobs(includes, excludes)
+	return rules
+}
+
+// SetGlobs replaces the --include/--exclude globs, keeping the rules loaded from .lodestoneignore files
+func (r *ignoreRules) SetGlobs(includes []string, excludes []string) {
+	includePatterns := []ignorePattern{}
+	for _, include := range includes {
+		if pattern, ok := parseIgnorePattern(include); ok {
+			includePatterns = append(includePatterns, pattern)
+		}
+	}
+	excludePatterns := []ignorePattern{}
+	for _, exclude := range append(append([]string{}, defaultIgnorePatterns...), excludes...) {
+		if pattern, ok := parseIgnorePattern(exclude); ok {
+			excludePatterns = append(excludePatterns, pattern)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.includes = includePatterns
+	r.excludes = excludePatterns
+}
+
+// LoadIgnoreFile (re)reads the .lodestoneignore file in the specified directory. If the file no longer exists,
+// its rules are forgotten.
+func (r *ignoreRules) LoadIgnoreFile(dir string) error {
+	dir = filepath.Clean(dir)
+	file, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if os.IsNotExist(err) {
+		r.mu.Lock()
+		delete(r.ignoreFiles, dir)
+		r.mu.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	patterns := []ignorePattern{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text()); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.ignoreFiles[dir] = patterns
+	r.mu.Unlock()
+	return nil
+}
+
+// IsIgnored returns true if the path (or any of its parent directories) is excluded, or if the path is a file that
+// does not match any of the include globs.
+func (r *ignoreRules) IsIgnored(fullPath string, isDir bool) bool {
+	relPath, err := filepath.Rel(r.root, fullPath)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// a file inside an ignored directory is ignored as well
+	segments := strings.Split(relPath, "/")
+	for i := 1; i < len(segments); i++ {
+		if r.isExcluded(strings.Join(segments[:i], "/"), true) {
+			return true
+		}
+	}
+	if r.isExcluded(relPath, isDir) {
+		return true
+	}
+
+	if !isDir && len(r.includes) > 0 {
+		for _, include := range r.includes {
+			if include.match(relPath, false) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (r *ignoreRules) isExcluded(relPath string, isDir bool) bool {
+	excluded := false
+	for _, pattern := range r.excludes {
+		if pattern.match(relPath, isDir) {
+			excluded = !pattern.negate
+		}
+	}
+
+	// .lodestoneignore files, from the root down to the parent directory of the path
+	dir := ""
+	for _, segment := range strings.Split(relPath, "/") {
+		for _, pattern := range r.ignoreFiles[filepath.Join(r.root, filepath.FromSlash(dir))] {
+			if pattern.match(strings.TrimPrefix(relPath, dir+"/"), isDir) {
+				excluded = !pattern.negate
+			}
+		}
+		dir = path.Join(dir, segment)
+	}
+	return excluded
+}
@@ -0,0 +1,207 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnorePatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// unanchored patterns match at any depth
+		{"*.tmp", "a.tmp", false, true},
+		{"*.tmp", "a/b/c.tmp", false, true},
+		{"*.tmp", "a.tmp.pdf", false, false},
+		{"build", "build", true, true},
+		{"build", "src/build", true, true},
+
+		// patterns containing a / are anchored to the base directory
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"docs/*.md", "docs/readme.md", false, true},
+		{"docs/*.md", "src/docs/readme.md", false, false},
+		{"docs/*.md", "docs/nested/readme.md", false, false},
+
+		// ** matches zero or more directories
+		{"**/logs", "logs", true, true},
+		{"**/logs", "a/b/logs", true, true},
+		{"logs/**", "logs/a", false, true},
+		{"logs/**", "logs/a/b.txt", false, true},
+		{"a/**/b", "a/b", true, true},
+		{"a/**/b", "a/x/y/b", true, true},
+		{"a/**/b", "x/a/b", true, false},
+
+		// directory-only patterns
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"cache/", "a/cache", true, true},
+
+		// escaped leading characters
+		{`\#notes.txt`, "#notes.txt", false, true},
+		{`\!important.txt`, "!important.txt", false, true},
+	}
+	for _, test := range tests {
+		pattern, ok := parseIgnorePattern(test.pattern)
+		if !ok {
+			t.Errorf("parseIgnorePattern(%q) was skipped", test.pattern)
+			continue
+		}
+		if got := pattern.match(test.path, test.isDir); got != test.want {
+			t.Errorf("%q match(%q, isDir=%v) = %v, want %v", test.pattern, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestParseIgnorePatternSkipped(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := parseIgnorePattern(line); ok {
+			t.Errorf("parseIgnorePattern(%q) should be skipped", line)
+		}
+	}
+}
+
+func TestIgnoreRulesIsIgnored(t *testing.T) {
+	tests := []struct {
+		name        string
+		includes    []string
+		excludes    []string
+		ignoreFiles map[string]string // directory (relative to the root) => contents
+		path        string
+		isDir       bool
+		want        bool
+	}{
+		{name: "plain file", path: "invoice.pdf", want: false},
+		{name: "default pattern", path: "a/.DS_Store", want: true},
+		{name: "default directory pattern", path: ".sync", isDir: true, want: true},
+		{name: "office lock file", path: "~$report.docx", want: true},
+		{name: "exclude glob", excludes: []string{"*.tmp"}, path: "a/b.tmp", want: true},
+
+		// the last matching pattern wins
+		{name: "negated exclude", excludes: []string{"*.log", "!keep.log"}, path: "keep.log", want: false},
+		{name: "negation overridden", excludes: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{
+			name:        "ignore file negates exclude glob",
+			excludes:    []string{"*.log"},
+			ignoreFiles: map[string]string{"": "!keep.log\n"},
+			path:        "keep.log",
+			want:        false,
+		},
+		{
+			name:        "nested ignore file overrides parent",
+			ignoreFiles: map[string]string{"": "*.csv\n", "data": "!*.csv\n"},
+			path:        "data/export.csv",
+			want:        false,
+		},
+		{
+			name:        "nested ignore file does not apply to siblings",
+			ignoreFiles: map[string]string{"data": "*.csv\n"},
+			path:        "other/export.csv",
+			want:        false,
+		},
+		{
+			name:        "nested ignore file patterns are relative to its directory",
+			ignoreFiles: map[string]string{"data": "/raw/\n"},
+			path:        "data/raw",
+			isDir:       true,
+			want:        true,
+		},
+		{
+			name:        "anchored pattern in nested ignore file",
+			ignoreFiles: map[string]string{"data": "/raw/\n"},
+			path:        "data/sub/raw",
+			isDir:       true,
+			want:        false,
+		},
+		{
+			name:        "comments and blank lines",
+			ignoreFiles: map[string]string{"": "# *.pdf\n\n"},
+			path:        "invoice.pdf",
+			want:        false,
+		},
+
+		// a file inside an excluded directory is excluded, even when a later pattern re-includes it
+		{name: "excluded parent directory", excludes: []string{"drafts/"}, path: "drafts/a/b.pdf", want: true},
+		{
+			name:     "excluded parent directory wins over negation",
+			excludes: []string{"drafts/", "!*.pdf"},
+			path:     "drafts/b.pdf",
+			want:     true,
+		},
+		{name: "directory-only pattern and file", excludes: []string{"drafts/"}, path: "drafts", want: false},
+
+		// includes only apply to files
+		{name: "included file", includes: []string{"*.pdf"}, path: "a/invoice.pdf", want: false},
+		{name: "not included file", includes: []string{"*.pdf"}, path: "a/notes.txt", want: true},
+		{name: "includes do not apply to directories", includes: []string{"*.pdf"}, path: "a", isDir: true, want: false},
+		{name: "exclude wins over include", includes: []string{"*.pdf"}, excludes: []string{"secret*"}, path: "secret.pdf", want: true},
+
+		// paths outside of the root are never ignored
+		{name: "root", path: "", isDir: true, want: false},
+		{name: "outside root", excludes: []string{"*"}, path: "../other.pdf", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			rules := newIgnoreRules(root, test.includes, test.excludes)
+			for dir, contents := range test.ignoreFiles {
+				dir = filepath.Join(root, filepath.FromSlash(dir))
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, IgnoreFileName), []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := rules.LoadIgnoreFile(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := rules.IsIgnored(filepath.Join(root, filepath.FromSlash(test.path)), test.isDir); got != test.want {
+				t.Errorf("IsIgnored(%q, isDir=%v) = %v, want %v", test.path, test.isDir, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreRulesReload(t *testing.T) {
+	root := t.TempDir()
+	rules := newIgnoreRules(root, nil, nil)
+	file := filepath.Join(root, "a.log")
+
+	if err := ioutil.WriteFile(filepath.Join(root, IgnoreFileName), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.LoadIgnoreFile(root); err != nil {
+		t.Fatal(err)
+	}
+	if !rules.IsIgnored(file, false) {
+		t.Errorf("%v should be ignored by the ignore file", file)
+	}
+
+	// a removed ignore file is forgotten
+	if err := os.Remove(filepath.Join(root, IgnoreFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.LoadIgnoreFile(root); err != nil {
+		t.Fatal(err)
+	}
+	if rules.IsIgnored(file, false) {
+		t.Errorf("%v should no longer be ignored", file)
+	}
+
+	// changed globs keep the ignore files
+	rules.SetGlobs(nil, []string{"*.LOG"})
+	if rules.IsIgnored(file, false) {
+		t.Errorf("globs are case sensitive, %v should not be ignored", file)
+	}
+	rules.SetGlobs(nil, []string{"*.log"})
+	if !rules.IsIgnored(file, false) {
+		t.Errorf("%v should be ignored by the exclude glob", file)
+	}
+}
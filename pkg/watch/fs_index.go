@@ -0,0 +1,129 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileIndex keeps track of every directory and regular file found under the watched directory.
+// fsnotify only reports a single event when a directory is removed, so the index is used to determine which
+// files were living inside it.
+type fileIndex struct {
+	dirs  map[string]bool
+	files map[string]os.FileInfo
+
+	// the last known entry of removed files, until their removal was published (see SaveState & ForgetRemoved)
+	removed map[string]os.FileInfo
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		dirs:    map[string]bool{},
+		files:   map[string]os.FileInfo{},
+		removed: map[string]os.FileInfo{},
+	}
+}
+
+func (idx *fileIndex) AddDir(path string) {
+	idx.dirs[filepath.Clean(path)] = true
+}
+
+func (idx *fileIndex) AddFile(path string, fi os.FileInfo) {
+	idx.files[filepath.Clean(path)] = fi
+	delete(idx.removed, filepath.Clean(path))
+}
+
+func (idx *fileIndex) File(path string) (os.FileInfo, bool) {
+	fi, ok := idx.files[filepath.Clean(path)]
+	return fi, ok
+}
+
+func (idx *fileIndex) IsDir(path string) bool {
+	return idx.dirs[filepath.Clean(path)]
+}
+
+// DirCount returns the number of indexed directories
+func (idx *fileIndex) DirCount() int {
+	return len(idx.dirs)
+}
+
+// Dirs returns the directory and every directory nested under it (sorted, parents before children)
+func (idx *fileIndex) Dirs(dir string) []string {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+
+	dirs := []string{}
+	for path := range idx.dirs {
+		if path == dir || strings.HasPrefix(path, prefix) {
+			dirs = append(dirs, path)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Files returns every file nested under the directory (sorted)
+func (idx *fileIndex) Files(dir string) []string {
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+
+	files := []string{}
+	for path := range idx.files {
+		if strings.HasPrefix(path, prefix) {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// RemoveFile deletes a single file from the index, returning true if the file was known.
+func (idx *fileIndex) RemoveFile(path string) bool {
+	path = filepath.Clean(path)
+	fi, ok := idx.files[path]
+	if !ok {
+		return false
+	}
+	delete(idx.files, path)
+	idx.removed[path] = fi
+	return true
+}
+
+// RemoveDir deletes the directory and everything nested under it from the index, and returns the paths of the
+// files that were removed (sorted, so that events are generated in a stable order)
+func (idx *fileIndex) RemoveDir(dir string) []string {
+	dir = filepath.Clean(dir)
+	prefix := dir + string(filepath.Separator)
+
+	delete(idx.dirs, dir)
+	for path := range idx.dirs {
+		if strings.HasPrefix(path, prefix) {
+			delete(idx.dirs, path)
+		}
+	}
+
+	removed := []string{}
+	for path, fi := range idx.files {
+		if strings.HasPrefix(path, prefix) {
+			removed = append(removed, path)
+			delete(idx.files, path)
+			idx.removed[path] = fi
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// ForgetRemoved drops the entries of removed files, except for the pending paths (files with unpublished events)
+func (idx *fileIndex) ForgetRemoved(pendingPaths []string) {
+	pending := map[string]bool{}
+	for _, path := range pendingPaths {
+		pending[filepath.Clean(path)] = true
+	}
+	for path := range idx.removed {
+		if !pending[path] {
+			delete(idx.removed, path)
+		}
+	}
+}
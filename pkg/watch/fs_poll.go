@@ -0,0 +1,290 @@
+package watch
+
+import (
+	"bufio"
+	"github.com/analogj/fsnotify"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filesystems where inotify does not (reliably) report changes made by other hosts
+var remoteFsTypes = []string{"nfs", "nfs4", "cifs", "smb3", "smbfs", "9p", "afs", "ceph", "glusterfs", "fuse", "fuseblk"}
+
+// fsEventWatcher is implemented by *fsnotify.Watcher and *pollWatcher
+type fsEventWatcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+}
+
+type pollEntry struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+
+	// the file was new or changed in the latest scan, and is waiting for the next scan to confirm that it is no longer
+	// being written to.
+	pending bool
+	// a created event has been generated for the file at some point
+	announced bool
+}
+
+// pollWatcher periodically walks the watched tree and diffs it against the previous snapshot, producing the same
+// events fsnotify would. It is used for network & FUSE filesystems where inotify never fires for remote writes.
+//
+// Only file metadata (size & modification time) is compared, so unchanged files are never re-read or rehashed.
+// New or modified files are only reported once they are unchanged between two consecutive scans, so that files which
+// are still being copied over the network are not published half written.
+type pollWatcher struct {
+	Events chan fsnotify.Event
+	Errors chan error
+
+	logger   *logrus.Entry
+	root     string
+	ignore   *ignoreRules
+	interval time.Duration
+	snapshot map[string]pollEntry
+	done     chan bool
+}
+
+func newPollWatcher(logger *logrus.Entry, root string, ignore *ignoreRules, interval time.Duration) *pollWatcher {
+	pw := &pollWatcher{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		logger:   logger,
+		root:     filepath.Clean(root),
+		ignore:   ignore,
+		interval: interval,
+		done:     make(chan bool),
+	}
+
+	// the first scan is the baseline, existing files are not reported (the same as the inotify watcher)
+	snapshot, err := pw.scan()
+	if err != nil {
+		logger.Errorln("error:", err)
+	}
+	pw.snapshot = snapshot
+	go pw.run()
+	return pw
+}
+
+// Add is a no-op, the poller always walks the whole tree (skipping ignored directories)
+func (pw *pollWatcher) Add(name string) error {
+	return nil
+}
+
+// Remove is a no-op, the poller always walks the whole tree (skipping ignored directories)
+func (pw *pollWatcher) Remove(name string) error {
+	return nil
+}
+
+func (pw *pollWatcher) Close() error {
+	close(pw.done)
+	return nil
+}
+
+func (pw *pollWatcher) run() {
+	defer close(pw.Events)
+	defer close(pw.Errors)
+
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-time.After(pw.interval):
+		}
+
+		start := time.Now()
+		snapshot, err := pw.scan()
+		if err != nil {
+			select {
+			case pw.Errors <- err:
+			case <-pw.done:
+				return
+			}
+			// an incomplete scan would look like mass deletion, wait for the next one instead
+			continue
+		}
+
+		events := pw.diff(pw.snapshot, snapshot)
+		pw.snapshot = snapshot
+		pw.logger.Debugf("Polled %d paths in %v, found %d changes", len(snapshot), time.Since(start), len(events))
+
+		for _, event := range events {
+			select {
+			case pw.Events <- event:
+			case <-pw.done:
+				return
+			}
+		}
+	}
+}
+
+// scan walks the tree, recording the metadata for every directory and regular file that is not ignored.
+func (pw *pollWatcher) scan() (map[string]pollEntry, error) {
+	snapshot := map[string]pollEntry{}
+	err := filepath.Walk(pw.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != pw.root {
+				// removed while we were walking
+				return nil
+			}
+			return err
+		}
+		// ignore files are always tracked, so that rule changes are picked up
+		if filepath.Base(path) != IgnoreFileName && pw.ignore.IsIgnored(path, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || fi.Mode().IsRegular() {
+			snapshot[path] = pollEntry{isDir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime(), announced: true}
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// diff compares two snapshots, and returns the events that describe the changes. It also carries the pending &
+// announced state of files over into the current snapshot.
+// Events are ordered so that they can be applied in sequence: created directories (parents first), created files,
+// removed files and finally removed directories (children first).
+func (pw *pollWatcher) diff(previous map[string]pollEntry, current map[string]pollEntry) []fsnotify.Event {
+	createdDirs := []string{}
+	createdFiles := []string{}
+	removedFiles := []string{}
+	removedDirs := []string{}
+
+	for path, entry := range current {
+		prevEntry, existed := previous[path]
+		if entry.isDir {
+			if !existed || !prevEntry.isDir {
+				createdDirs = append(createdDirs, path)
+			}
+			continue
+		}
+
+		changed := !existed || prevEntry.isDir || prevEntry.size != entry.size || !prevEntry.modTime.Equal(entry.modTime)
+		entry.announced = existed && !prevEntry.isDir && prevEntry.announced
+		if filepath.Base(path) == IgnoreFileName {
+			// rule changes apply immediately
+			if changed {
+				createdFiles = append(createdFiles, path)
+				entry.announced = true
+			}
+		} else if changed {
+			entry.pending = true
+		} else if prevEntry.pending {
+			// file has settled
+			createdFiles = append(createdFiles, path)
+			entry.announced = true
+		}
+		current[path] = entry
+	}
+
+	for path, prevEntry := range previous {
+		if entry, exists := current[path]; exists && entry.isDir == prevEntry.isDir {
+			continue
+		}
+		if prevEntry.isDir {
+			removedDirs = append(removedDirs, path)
+		} else if !prevEntry.announced {
+			// never reported as created, so there is nothing to remove
+			continue
+		} else if filepath.Base(path) == IgnoreFileName || !pw.ignore.IsIgnored(path, false) {
+			removedFiles = append(removedFiles, path)
+		}
+	}
+
+	sort.Strings(createdDirs)
+	sort.Strings(createdFiles)
+	sort.Strings(removedFiles)
+	sort.Sort(sort.Reverse(sort.StringSlice(removedDirs)))
+
+	events := []fsnotify.Event{}
+	for _, path := range createdDirs {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+	}
+	for _, path := range createdFiles {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+	}
+	for _, path := range removedFiles {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	}
+	for _, path := range removedDirs {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	}
+	return events
+}
+
+// Helpers
+
+// remoteMountType returns the filesystem type of the mount containing the path, if it is a network or FUSE
+// filesystem (where inotify is unreliable). An empty string is returned for local filesystems, or if the mount
+// table cannot be read (eg. on non-linux systems).
+func remoteMountType(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	if resolvedPath, err := filepath.EvalSymlinks(absPath); err == nil {
+		absPath = resolvedPath
+	}
+
+	mounts, err := os.Open("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	defer mounts.Close()
+
+	// find the longest mount point containing the path
+	mountPoint := ""
+	fsType := ""
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		currentMountPoint := unescapeMountPath(fields[1])
+		if absPath != currentMountPoint && !strings.HasPrefix(absPath, strings.TrimSuffix(currentMountPoint, "/")+"/") {
+			continue
+		}
+		if len(currentMountPoint) >= len(mountPoint) {
+			mountPoint = currentMountPoint
+			fsType = fields[2]
+		}
+	}
+
+	for _, remoteFsType := range remoteFsTypes {
+		if fsType == remoteFsType || strings.HasPrefix(fsType, "fuse.") {
+			return fsType
+		}
+	}
+	return ""
+}
+
+// /proc/mounts escapes whitespace & backslashes as octal sequences (eg. \040 for space)
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	unescaped := strings.Builder{}
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if char, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(char))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
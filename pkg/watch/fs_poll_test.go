@@ -0,0 +1,325 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"github.com/analogj/fsnotify"
+	"github.com/analogj/lodestone-publisher/pkg/model"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPoller drives the scans of a pollWatcher directly, without the polling goroutine
+type testPoller struct {
+	t    *testing.T
+	root string
+	pw   *pollWatcher
+
+	// handle is called for each event, in order, when set
+	handle func(event fsnotify.Event)
+}
+
+func newTestPoller(t *testing.T, excludes ...string) *testPoller {
+	root := t.TempDir()
+	return &testPoller{
+		t:    t,
+		root: root,
+		pw: &pollWatcher{
+			logger:   logrus.NewEntry(logrus.New()),
+			root:     root,
+			ignore:   newIgnoreRules(root, nil, excludes),
+			snapshot: map[string]pollEntry{},
+		},
+	}
+}
+
+// baseline takes the initial snapshot, existing files are not reported
+func (p *testPoller) baseline() {
+	snapshot, err := p.pw.scan()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.pw.snapshot = snapshot
+}
+
+// poll scans the tree, and returns the events as "create path" or "remove path", relative to the root
+func (p *testPoller) poll() []string {
+	snapshot, err := p.pw.scan()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	events := []string{}
+	for _, event := range p.pw.diff(p.pw.snapshot, snapshot) {
+		if p.handle != nil {
+			p.handle(event)
+		}
+		relPath, _ := filepath.Rel(p.root, event.Name)
+		switch event.Op {
+		case fsnotify.Create:
+			events = append(events, "create "+filepath.ToSlash(relPath))
+		case fsnotify.Remove:
+			events = append(events, "remove "+filepath.ToSlash(relPath))
+		default:
+			p.t.Fatalf("unexpected event: %v", event)
+		}
+	}
+	p.pw.snapshot = snapshot
+	return events
+}
+
+func (p *testPoller) expect(want ...string) {
+	p.t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if got := p.poll(); !reflect.DeepEqual(got, want) {
+		p.t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+// write creates (or replaces) the file, with an explicit modification time so that changes are always detected
+func (p *testPoller) write(relPath string, content string, modTime time.Time) {
+	path := filepath.Join(p.root, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *testPoller) remove(relPath string) {
+	if err := os.RemoveAll(filepath.Join(p.root, filepath.FromSlash(relPath))); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+var testModTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPollWatcherBaseline(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("existing.pdf", "content", testModTime)
+	p.baseline()
+
+	p.expect()
+	p.expect()
+}
+
+func TestPollWatcherCreatedFileSettles(t *testing.T) {
+	p := newTestPoller(t)
+	p.baseline()
+
+	p.write("new.pdf", "partial", testModTime)
+	p.expect() // pending, may still be written to
+	p.expect("create new.pdf")
+	p.expect() // reported once
+}
+
+func TestPollWatcherGrowingFileIsHeldBack(t *testing.T) {
+	p := newTestPoller(t)
+	p.baseline()
+
+	p.write("copy.pdf", "part", testModTime)
+	p.expect()
+	p.write("copy.pdf", "part 2", testModTime.Add(time.Second))
+	p.expect()
+	p.write("copy.pdf", "part 2 3", testModTime.Add(2*time.Second))
+	p.expect()
+	p.expect("create copy.pdf")
+}
+
+func TestPollWatcherModifiedFile(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("a.pdf", "v1", testModTime)
+	p.baseline()
+
+	// same size, newer modification time
+	p.write("a.pdf", "v2", testModTime.Add(time.Second))
+	p.expect()
+	p.expect("create a.pdf")
+
+	// different size, same modification time
+	p.write("a.pdf", "version 3", testModTime.Add(time.Second))
+	p.expect()
+	p.expect("create a.pdf")
+}
+
+func TestPollWatcherRemovedFile(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("a.pdf", "content", testModTime)
+	p.baseline()
+
+	p.remove("a.pdf")
+	p.expect("remove a.pdf")
+	p.expect()
+}
+
+func TestPollWatcherRemovedBeforeSettling(t *testing.T) {
+	p := newTestPoller(t)
+	p.baseline()
+
+	p.write("tmp.pdf", "content", testModTime)
+	p.expect()
+	p.remove("tmp.pdf")
+	p.expect() // never announced, so nothing to remove
+}
+
+func TestPollWatcherModifiedAnnouncedFileRemoved(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("a.pdf", "v1", testModTime)
+	p.baseline()
+
+	// still announced while the modification is pending
+	p.write("a.pdf", "version 2", testModTime.Add(time.Second))
+	p.expect()
+	p.remove("a.pdf")
+	p.expect("remove a.pdf")
+}
+
+func TestPollWatcherDirectories(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("old/nested/a.pdf", "a", testModTime)
+	p.write("old/b.pdf", "b", testModTime)
+	p.baseline()
+
+	// directories are reported immediately, parents first
+	p.write("new/nested/c.pdf", "c", testModTime)
+	p.expect("create new", "create new/nested")
+	p.expect("create new/nested/c.pdf")
+
+	// removed files before their directories, children first
+	p.remove("old")
+	p.expect("remove old/b.pdf", "remove old/nested/a.pdf", "remove old/nested", "remove old")
+}
+
+func TestPollWatcherFileReplacedByDirectory(t *testing.T) {
+	p := newTestPoller(t)
+	p.write("a", "content", testModTime)
+	p.baseline()
+
+	p.remove("a")
+	p.write("a/b.pdf", "b", testModTime)
+	p.expect("create a", "remove a")
+	p.expect("create a/b.pdf")
+}
+
+func TestPollWatcherIgnored(t *testing.T) {
+	p := newTestPoller(t, "*.tmp", "drafts/")
+	p.write(IgnoreFileName, "*.log\n", testModTime)
+	p.baseline()
+
+	p.write("a.tmp", "a", testModTime)
+	p.write("drafts/b.pdf", "b", testModTime)
+	p.expect()
+	p.expect()
+
+	// ignore files are reported without waiting, so rule changes apply immediately
+	p.write(IgnoreFileName, "*.log\n*.csv\n", testModTime.Add(time.Second))
+	p.expect("create " + IgnoreFileName)
+
+	p.remove(IgnoreFileName)
+	p.expect("remove " + IgnoreFileName)
+}
+
+// recordingNotifier collects the key & size of the published objects, or fails with err when set
+type recordingNotifier struct {
+	mutex     sync.Mutex
+	published []string
+	err       error
+}
+
+func (n *recordingNotifier) Init(logger *logrus.Entry, config map[string]string) error {
+	return nil
+}
+
+func (n *recordingNotifier) Publish(ctx context.Context, event model.S3Event) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.err != nil {
+		return n.err
+	}
+	for _, record := range event.Records {
+		n.published = append(n.published, fmt.Sprintf("%v %v %d", record.EventName, record.S3.Object.Key, record.S3.Object.Size))
+	}
+	return nil
+}
+
+func (n *recordingNotifier) Close() error {
+	return nil
+}
+
+func (n *recordingNotifier) expect(t *testing.T, want ...string) {
+	t.Helper()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	sort.Strings(n.published)
+	if len(n.published) != len(want) || (len(want) > 0 && !reflect.DeepEqual(n.published, want)) {
+		t.Errorf("published = %q, want %q", n.published, want)
+	}
+}
+
+func TestPollModeNewDirectoryWaitsForFiles(t *testing.T) {
+	p := newTestPoller(t)
+	p.baseline()
+
+	notifier := &recordingNotifier{}
+	fs := &FsWatcher{
+		logger:        p.pw.logger,
+		config:        FsConfig{Dir: p.root, Bucket: "documents"},
+		watcher:       p.pw,
+		polling:       true,
+		index:         newFileIndex(),
+		ignore:        p.pw.ignore,
+		pool:          newTestPool(t),
+		unwatchedDirs: map[string]bool{},
+	}
+	fs.index.AddDir(p.root)
+	p.handle = func(event fsnotify.Event) {
+		fs.handleEvent(notifier, event)
+	}
+
+	// a folder is copied in, and its files are still being written
+	p.write("new/a.pdf", "part", testModTime)
+	p.write("new/nested/b.pdf", "part", testModTime)
+	p.expect("create new", "create new/nested")
+	waitIdle(t, fs.pool)
+	notifier.expect(t)
+	if !fs.index.IsDir(filepath.Join(p.root, "new", "nested")) {
+		t.Error("new directories are not indexed")
+	}
+
+	p.write("new/a.pdf", "complete", testModTime.Add(time.Second))
+	p.expect("create new/nested/b.pdf")
+	p.expect("create new/a.pdf")
+	p.expect()
+	waitIdle(t, fs.pool)
+
+	// exactly one event per file, once it settled
+	notifier.expect(t, "s3:ObjectCreated:Put new/a.pdf 8", "s3:ObjectCreated:Put new/nested/b.pdf 4")
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	tests := map[string]string{
+		"/mnt/share":             "/mnt/share",
+		`/mnt/my\040share`:       "/mnt/my share",
+		`/mnt/tab\011and\134bs`:  "/mnt/tab\tand\\bs",
+		`/mnt/not\0escaped`:      `/mnt/not\0escaped`,
+		`/mnt/trailing\`:         `/mnt/trailing\`,
+		`/mnt/invalid\999octals`: `/mnt/invalid\999octals`,
+	}
+	for path, want := range tests {
+		if got := unescapeMountPath(path); got != want {
+			t.Errorf("unescapeMountPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package watch
+
+import (
+	"github.com/analogj/fsnotify"
+	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// When retrying directories that could not be watched because the inotify watch limit was reached
+const unwatchedRescanInterval = 1 * time.Minute
+
+// The event loop ticks at least every unwatchedRescanInterval, but may be blocked for a while when the publishers
+// apply backpressure
+const fsLivenessTimeout = 5 * unwatchedRescanInterval
+
+// rescan walks the subtree and reconciles it against the file index, publishing the events that were missed
+// (eg. after the inotify queue overflowed, or for a directory that could not be watched). Directories that are
+// not watched yet are (re)registered.
+// Returns the number of recovered events.
+func (fs *FsWatcher) rescan(notifyClient notify.Interface, dir string) int {
+	fs.logger.Infof("Rescanning directory: %v", dir)
+	if _, err := os.Stat(fs.config.Dir); err != nil {
+		// if the watched directory is unavailable (eg. an unmounted network share) everything would look deleted
+		fs.logger.Errorf("Unable to rescan, watched directory is unavailable: %v", err)
+		return 0
+	}
+
+	recovered := 0
+	seenDirs := map[string]bool{}
+	seenFiles := map[string]bool{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		// large rescans run on the event loop
+		fs.touch()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed while we were walking, will be handled below
+				return nil
+			}
+			return err
+		}
+		if fs.ignore.IsIgnored(path, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			seenDirs[filepath.Clean(path)] = true
+			return fs.AddWatchDir(path, fi, nil)
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		seenFiles[filepath.Clean(path)] = true
+		indexedInfo, indexed := fs.index.File(path)
+		if indexed && indexedInfo.Size() == fi.Size() && indexedInfo.ModTime().Equal(fi.ModTime()) {
+			return nil
+		}
+		fs.index.AddFile(path, fi)
+		fs.publishEvent(notifyClient, "s3:ObjectCreated:Put", fsnotify.Event{Name: path, Op: fsnotify.Create})
+		recovered++
+		return nil
+	})
+	if fs.CheckErr(err) {
+		// an incomplete walk would look like mass deletion, only report the created files
+		fs.logger.Warnf("Rescan of %v was incomplete, recovered %d events", dir, recovered)
+		return recovered
+	}
+
+	for _, file := range fs.index.Files(dir) {
+		if !seenFiles[file] {
+			fs.index.RemoveFile(file)
+			fs.publishEvent(notifyClient, "s3:ObjectRemoved:Delete", fsnotify.Event{Name: file, Op: fsnotify.Remove})
+			recovered++
+		}
+	}
+	dirs := fs.index.Dirs(dir)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, removedDir := range dirs {
+		if !seenDirs[removedDir] {
+			fs.index.RemoveDir(removedDir)
+			fs.RemoveWatchDir(removedDir, nil, nil)
+		}
+	}
+
+	fs.logger.Infof("Rescan of %v recovered %d events", dir, recovered)
+	return recovered
+}
+
+// rescanUnwatchedDirs retries the directories that could not be watched because the inotify watch limit was reached.
+// Nested directories are covered by the rescan of their parent.
+func (fs *FsWatcher) rescanUnwatchedDirs(notifyClient notify.Interface) {
+	dirs := []string{}
+	for dir := range fs.unwatchedDirs {
+		if !fs.index.IsDir(dir) {
+			// removed in the mean time
+			delete(fs.unwatchedDirs, dir)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	rescanned := []string{}
+	for _, dir := range dirs {
+		covered := false
+		for _, parent := range rescanned {
+			if strings.HasPrefix(dir, parent+string(filepath.Separator)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			fs.rescan(notifyClient, dir)
+			rescanned = append(rescanned, dir)
+		}
+	}
+}
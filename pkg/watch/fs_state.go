@@ -0,0 +1,111 @@
+package watch
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// indexState is the on-disk representation of the file index, written on shutdown so that the changes made while
+// the publisher was not running can be published when it restarts.
+type indexState struct {
+	Dir   string                    `json:"dir"`
+	Files map[string]indexStateFile `json:"files"`
+}
+
+type indexStateFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// stateFileInfo implements os.FileInfo for files loaded from the state file. Only the size & modification time are
+// used, to detect changes.
+type stateFileInfo struct {
+	name string
+	indexStateFile
+}
+
+func (fi stateFileInfo) Name() string       { return fi.name }
+func (fi stateFileInfo) Size() int64        { return fi.indexStateFile.Size }
+func (fi stateFileInfo) Mode() os.FileMode  { return 0 }
+func (fi stateFileInfo) ModTime() time.Time { return fi.indexStateFile.ModTime }
+func (fi stateFileInfo) IsDir() bool        { return false }
+func (fi stateFileInfo) Sys() interface{}   { return nil }
+
+// stateFilePath returns the state file for the watched directory, or an empty string if state is not persisted.
+func stateFilePath(config FsConfig) string {
+	if config.StateDir == "" {
+		return ""
+	}
+	dir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		dir = config.Dir
+	}
+	hash := sha1.Sum([]byte(dir))
+	return filepath.Join(config.StateDir, "fs-"+hex.EncodeToString(hash[:8])+".json")
+}
+
+// SaveState writes the files in the index to the state file, so that the events that have not been published yet (the
+// pending paths) are published again on restart:
+//   - files with a pending create are left out, the restart rescan finds them as new files
+//   - removed files with a pending removal are written with their last known entry, the restart rescan finds them
+//     missing
+func (idx *fileIndex) SaveState(stateFile string, dir string, pendingPaths []string) error {
+	pending := map[string]bool{}
+	for _, path := range pendingPaths {
+		pending[filepath.Clean(path)] = true
+	}
+
+	state := indexState{
+		Dir:   dir,
+		Files: map[string]indexStateFile{},
+	}
+	for path, fi := range idx.files {
+		if !pending[path] {
+			state.Files[path] = indexStateFile{Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+	}
+	for path, fi := range idx.removed {
+		if pending[path] {
+			state.Files[path] = indexStateFile{Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a truncated state file behind
+	tmpFile := stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, stateFile)
+}
+
+// LoadState adds the files from the state file to the index. Returns false if there is no state file.
+func (idx *fileIndex) LoadState(stateFile string) (bool, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	state := indexState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, err
+	}
+	for path, file := range state.Files {
+		idx.AddFile(path, stateFileInfo{name: filepath.Base(path), indexStateFile: file})
+	}
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package watch
+
+import (
+	"errors"
+	"github.com/analogj/fsnotify"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFsWatcher returns a watcher with an empty index, that is not watching the directory
+func newTestFsWatcher(t *testing.T, root string) *FsWatcher {
+	return &FsWatcher{
+		logger:        logrus.NewEntry(logrus.New()),
+		config:        FsConfig{Dir: root, Bucket: "documents"},
+		watcher:       &pollWatcher{},
+		index:         newFileIndex(),
+		ignore:        newIgnoreRules(root, nil, nil),
+		pool:          newTestPool(t),
+		unwatchedDirs: map[string]bool{},
+	}
+}
+
+// index adds the files & directories to the index, as on a start without state
+func index(t *testing.T, fs *FsWatcher) {
+	t.Helper()
+	if err := filepath.Walk(fs.config.Dir, fs.AddWatchDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveStateRepublishesRemovalsAfterRestart(t *testing.T) {
+	tests := []struct {
+		name      string
+		publisher error
+		want      []string
+	}{
+		{name: "published removals", want: nil},
+		{
+			name:      "failed removals",
+			publisher: errors.New("not connected"),
+			want:      []string{"s3:ObjectRemoved:Delete a.pdf 0", "s3:ObjectRemoved:Delete dir/c.pdf 0"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			stateFile := filepath.Join(t.TempDir(), "state.json")
+			p := &testPoller{t: t, root: root}
+			p.write("a.pdf", "a", testModTime)
+			p.write("b.pdf", "b", testModTime)
+			p.write("dir/c.pdf", "c", testModTime)
+
+			fs := newTestFsWatcher(t, root)
+			index(t, fs)
+			p.remove("a.pdf")
+			p.remove("dir")
+			notifier := &recordingNotifier{err: test.publisher}
+			fs.handleEvent(notifier, removeEvent(root, "a.pdf"))
+			fs.handleEvent(notifier, removeEvent(root, "dir"))
+			waitIdle(t, fs.pool)
+
+			// as on the event loop, then on shutdown
+			fs.index.ForgetRemoved(fs.pool.Pending())
+			if err := fs.index.SaveState(stateFile, root, fs.pool.Pending()); err != nil {
+				t.Fatal(err)
+			}
+
+			restarted := newTestFsWatcher(t, root)
+			if restored, err := restarted.index.LoadState(stateFile); err != nil || !restored {
+				t.Fatalf("LoadState() = %v, %v", restored, err)
+			}
+			notifier = &recordingNotifier{}
+			restarted.rescan(notifier, root)
+			waitIdle(t, restarted.pool)
+			notifier.expect(t, test.want...)
+		})
+	}
+}
+
+func TestSaveStateLeavesOutPendingCreates(t *testing.T) {
+	root := t.TempDir()
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	p := &testPoller{t: t, root: root}
+	p.write("a.pdf", "a", testModTime)
+	p.write("b.pdf", "b", testModTime)
+
+	fs := newTestFsWatcher(t, root)
+	index(t, fs)
+	if err := fs.index.SaveState(stateFile, root, []string{filepath.Join(root, "a.pdf")}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newFileIndex()
+	if _, err := restored.LoadState(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.File(filepath.Join(root, "a.pdf")); ok {
+		t.Error("file with a pending create was saved")
+	}
+	if _, ok := restored.File(filepath.Join(root, "b.pdf")); !ok {
+		t.Error("published file was not saved")
+	}
+}
+
+// removeEvent is the remove event for the path relative to the root
+func removeEvent(root string, relPath string) fsnotify.Event {
+	return fsnotify.Event{Name: filepath.Join(root, relPath), Op: fsnotify.Remove}
+}
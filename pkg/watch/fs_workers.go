@@ -0,0 +1,279 @@
+package watch
+
+import (
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When logging the worker pool statistics
+const poolStatsInterval = 1 * time.Minute
+
+// When retrying failed jobs, the delay doubles after every failed attempt
+const (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// poolStats describes the state of a publishPool, and how much backpressure it is applying to the event loop
+type poolStats struct {
+	Workers    int
+	Queued     int64         // jobs waiting for a worker
+	InFlight   int64         // jobs currently being processed
+	Processed  int64         // jobs completed since start
+	Blocked    int64         // number of submits that had to wait for queue space
+	BlockedFor time.Duration // total time submitters spent waiting for queue space
+}
+
+// publishPool runs (slow) jobs like hashing, uploading & publishing on a bounded set of workers, so that the event loop
+// can keep draining filesystem events.
+// Jobs are sharded by key (the file path), so jobs for the same path always run on the same worker and are processed
+// in the order they were submitted. When a worker's queue is full, Submit blocks.
+// Failed jobs are remembered, and run again by Retry (with backoff) until they succeed or a newer job is submitted
+// for the same key.
+type publishPool struct {
+	logger *logrus.Entry
+	queues []chan func()
+	wg     sync.WaitGroup
+	done   chan bool
+
+	// number of unfinished jobs for each key, and the last job for each key if it failed
+	pendingMutex sync.Mutex
+	pending      map[string]int
+	failed       map[string]failedJob
+
+	// updated atomically
+	queued     int64
+	inFlight   int64
+	processed  int64
+	blocked    int64
+	blockedFor int64
+
+	// exported to prometheus, labelled with the watched directory
+	metricsLabel      string
+	queuedGauge       prometheus.Gauge
+	inFlightGauge     prometheus.Gauge
+	blockedCounter    prometheus.Counter
+	blockedForCounter prometheus.Counter
+}
+
+type failedJob struct {
+	job      func() error
+	attempts int
+	retryAt  time.Time
+}
+
+// newPublishPool starts the workers. The pool's metrics are labelled with dir, the watched directory.
+func newPublishPool(logger *logrus.Entry, dir string, workers int, queueSize int) *publishPool {
+	pool := &publishPool{
+		logger:  logger,
+		queues:  make([]chan func(), workers),
+		done:    make(chan bool),
+		pending: map[string]int{},
+		failed:  map[string]failedJob{},
+
+		metricsLabel:      dir,
+		queuedGauge:       metrics.WorkerQueuedJobs.WithLabelValues(dir),
+		inFlightGauge:     metrics.WorkerInFlightJobs.WithLabelValues(dir),
+		blockedCounter:    metrics.WorkerBlockedSubmits.WithLabelValues(dir),
+		blockedForCounter: metrics.WorkerBlockedSeconds.WithLabelValues(dir),
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan func(), queueSize)
+		pool.wg.Add(1)
+		go pool.work(pool.queues[i])
+	}
+	go pool.reportStats()
+	return pool
+}
+
+// Submit queues the job on the worker responsible for the key, blocking if that worker's queue is full.
+// The job replaces any failed job for the key, which will no longer be retried.
+func (p *publishPool) Submit(key string, job func() error) {
+	p.submit(key, job, 0)
+}
+
+// Retry submits the failed jobs that are due to be retried. It must not be called concurrently with Close.
+func (p *publishPool) Retry() {
+	now := time.Now()
+	retries := map[string]failedJob{}
+	p.pendingMutex.Lock()
+	for key, failed := range p.failed {
+		// a job that is still pending for the key will replace the failed one
+		if p.pending[key] == 0 && !now.Before(failed.retryAt) {
+			retries[key] = failed
+		}
+	}
+	p.pendingMutex.Unlock()
+
+	for key, failed := range retries {
+		p.logger.Infof("Retrying failed event for %v (attempt %d)", key, failed.attempts+1)
+		p.submit(key, failed.job, failed.attempts)
+	}
+}
+
+func (p *publishPool) submit(key string, job func() error, attempts int) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	queue := p.queues[hash.Sum32()%uint32(len(p.queues))]
+
+	p.pendingMutex.Lock()
+	p.pending[key]++
+	delete(p.failed, key)
+	p.pendingMutex.Unlock()
+	tracked := p.trackPending(key, job, attempts)
+
+	atomic.AddInt64(&p.queued, 1)
+	p.queuedGauge.Inc()
+	select {
+	case queue <- tracked:
+	default:
+		// queue is full, apply backpressure
+		start := time.Now()
+		queue <- tracked
+		blockedFor := time.Since(start)
+		atomic.AddInt64(&p.blocked, 1)
+		atomic.AddInt64(&p.blockedFor, int64(blockedFor))
+		p.blockedCounter.Inc()
+		p.blockedForCounter.Add(blockedFor.Seconds())
+	}
+}
+
+// Close stops accepting jobs, and waits up to the timeout for the queued jobs to complete.
+// Returns false if the timeout expired first, in which case the remaining jobs are abandoned (see Pending).
+func (p *publishPool) Close(timeout time.Duration) bool {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	defer close(p.done)
+	defer p.deleteMetrics()
+
+	finished := make(chan bool)
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Pending returns the keys that have jobs which have not completed yet, or whose last job failed (and has not been
+// retried successfully)
+func (p *publishPool) Pending() []string {
+	p.pendingMutex.Lock()
+	defer p.pendingMutex.Unlock()
+
+	keys := []string{}
+	for key := range p.pending {
+		keys = append(keys, key)
+	}
+	for key := range p.failed {
+		if _, ok := p.pending[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (p *publishPool) Stats() poolStats {
+	return poolStats{
+		Workers:    len(p.queues),
+		Queued:     atomic.LoadInt64(&p.queued),
+		InFlight:   atomic.LoadInt64(&p.inFlight),
+		Processed:  atomic.LoadInt64(&p.processed),
+		Blocked:    atomic.LoadInt64(&p.blocked),
+		BlockedFor: time.Duration(atomic.LoadInt64(&p.blockedFor)),
+	}
+}
+
+// deleteMetrics stops exporting the pool's metrics, the watched directory may not be watched again
+func (p *publishPool) deleteMetrics() {
+	metrics.WorkerQueuedJobs.DeleteLabelValues(p.metricsLabel)
+	metrics.WorkerInFlightJobs.DeleteLabelValues(p.metricsLabel)
+	metrics.WorkerBlockedSubmits.DeleteLabelValues(p.metricsLabel)
+	metrics.WorkerBlockedSeconds.DeleteLabelValues(p.metricsLabel)
+}
+
+func (p *publishPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for job := range queue {
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddInt64(&p.inFlight, 1)
+		p.queuedGauge.Dec()
+		p.inFlightGauge.Inc()
+		job()
+		atomic.AddInt64(&p.inFlight, -1)
+		atomic.AddInt64(&p.processed, 1)
+		p.inFlightGauge.Dec()
+	}
+}
+
+// trackPending wraps the job, so that the pending jobs for each key are counted, and the job is remembered if it
+// failed (unless a newer job for the key is already queued)
+func (p *publishPool) trackPending(key string, job func() error, attempts int) func() {
+	return func() {
+		err := job()
+
+		p.pendingMutex.Lock()
+		defer p.pendingMutex.Unlock()
+		if p.pending[key]--; p.pending[key] > 0 {
+			return
+		}
+		delete(p.pending, key)
+		if err != nil {
+			attempts++
+			p.failed[key] = failedJob{job: job, attempts: attempts, retryAt: time.Now().Add(retryDelay(attempts))}
+		}
+	}
+}
+
+// retryDelay is the backoff before the next attempt of a job that failed the specified number of times
+func retryDelay(attempts int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (p *publishPool) reportStats() {
+	ticker := time.NewTicker(poolStatsInterval)
+	defer ticker.Stop()
+
+	lastBlocked := int64(0)
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		stats := p.Stats()
+		logger := p.logger.WithFields(logrus.Fields{
+			"workers":     stats.Workers,
+			"queued":      stats.Queued,
+			"in_flight":   stats.InFlight,
+			"processed":   stats.Processed,
+			"blocked":     stats.Blocked,
+			"blocked_for": stats.BlockedFor,
+		})
+		if stats.Blocked > lastBlocked {
+			logger.Warnln("Worker pool is saturated, the event loop was blocked waiting for queue space")
+		} else {
+			logger.Debugln("Worker pool stats")
+		}
+		lastBlocked = stats.Blocked
+	}
+}
@@ -0,0 +1,162 @@
+package watch
+
+import (
+	"errors"
+	"github.com/analogj/lodestone-publisher/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T) *publishPool {
+	pool := newPublishPool(logrus.NewEntry(logrus.New()), t.Name(), 2, 10)
+	t.Cleanup(func() { pool.Close(time.Second) })
+	return pool
+}
+
+// waitIdle blocks until the pool has no queued or running jobs
+func waitIdle(t *testing.T, pool *publishPool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.pendingMutex.Lock()
+		idle := len(pool.pending) == 0
+		pool.pendingMutex.Unlock()
+		if idle {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pool")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expire makes the failed jobs due for a retry
+func expire(pool *publishPool) {
+	pool.pendingMutex.Lock()
+	defer pool.pendingMutex.Unlock()
+	for key, failed := range pool.failed {
+		failed.retryAt = time.Time{}
+		pool.failed[key] = failed
+	}
+}
+
+func TestPublishPoolRetriesFailedJobs(t *testing.T) {
+	pool := newTestPool(t)
+	var mu sync.Mutex
+	runs := 0
+	pool.Submit("a", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if runs++; runs < 3 {
+			return errors.New("upload failed")
+		}
+		return nil
+	})
+	waitIdle(t, pool)
+
+	// not retried before the backoff expired
+	pool.Retry()
+	waitIdle(t, pool)
+	if runs != 1 {
+		t.Fatalf("runs = %d, want 1", runs)
+	}
+	if failed := pool.failed["a"]; failed.attempts != 1 || time.Until(failed.retryAt) <= 0 {
+		t.Errorf("failed job = %+v, want 1 attempt with a retry in the future", failed)
+	}
+
+	for i := 0; i < 2; i++ {
+		expire(pool)
+		pool.Retry()
+		waitIdle(t, pool)
+	}
+	if runs != 3 {
+		t.Errorf("runs = %d, want 3", runs)
+	}
+	if len(pool.failed) != 0 {
+		t.Errorf("failed jobs = %v, want none after a successful retry", pool.failed)
+	}
+}
+
+func TestPublishPoolNewerJobReplacesFailedJob(t *testing.T) {
+	pool := newTestPool(t)
+	pool.Submit("a", func() error { return errors.New("publish failed") })
+	waitIdle(t, pool)
+	if _, ok := pool.failed["a"]; !ok {
+		t.Fatal("failed job was not remembered")
+	}
+
+	pool.Submit("a", func() error { return nil })
+	waitIdle(t, pool)
+	if len(pool.failed) != 0 {
+		t.Errorf("failed jobs = %v, want none", pool.failed)
+	}
+}
+
+func TestPublishPoolPendingIncludesFailedJobs(t *testing.T) {
+	pool := newTestPool(t)
+	pool.Submit("failed", func() error { return errors.New("not connected") })
+	pool.Submit("published", func() error { return nil })
+	waitIdle(t, pool)
+
+	if pending := pool.Pending(); !reflect.DeepEqual(pending, []string{"failed"}) {
+		t.Errorf("Pending() = %v, want [failed]", pending)
+	}
+}
+
+func TestPublishPoolMetrics(t *testing.T) {
+	pool := newPublishPool(logrus.NewEntry(logrus.New()), t.Name(), 1, 1)
+	defer pool.Close(time.Second)
+
+	release := make(chan bool)
+	started := make(chan bool)
+	pool.Submit("a", func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	pool.Submit("b", func() error { return nil })
+	if got := testutil.ToFloat64(metrics.WorkerInFlightJobs.WithLabelValues(t.Name())); got != 1 {
+		t.Errorf("in flight = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.WorkerQueuedJobs.WithLabelValues(t.Name())); got != 1 {
+		t.Errorf("queued = %v, want 1", got)
+	}
+
+	// the queue is full, so the next submit blocks until the first job completes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	pool.Submit("c", func() error { return nil })
+	waitIdle(t, pool)
+
+	if got := testutil.ToFloat64(metrics.WorkerBlockedSubmits.WithLabelValues(t.Name())); got != 1 {
+		t.Errorf("blocked submits = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.WorkerBlockedSeconds.WithLabelValues(t.Name())); got < 0.04 {
+		t.Errorf("blocked seconds = %v, want at least 0.04", got)
+	}
+	if got := testutil.ToFloat64(metrics.WorkerQueuedJobs.WithLabelValues(t.Name())); got != 0 {
+		t.Errorf("queued = %v, want 0", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:   minRetryDelay,
+		2:   2 * minRetryDelay,
+		3:   4 * minRetryDelay,
+		100: maxRetryDelay,
+	}
+	for attempts, want := range tests {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Interface is implemented by every event source (filesystem, email, etc)
+type Interface interface {
+	// Validate checks the source config without starting anything, returning a *ConfigError naming the invalid key.
+	Validate(config map[string]string) error
+
+	// Start runs the source, publishing events using the notify client. It blocks until the context is cancelled
+	// (returning nil once in-flight work is finished) or the source fails.
+	Start(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface, config map[string]string) error
+
+	// Status reports the current state of the source. It is safe to call concurrently with Start.
+	Status() Status
+}
+
+// Reloader is implemented by sources that can apply a config change without restarting (and losing their in-memory
+// state). Reload returns ErrRestartRequired if the change cannot be applied in place.
+type Reloader interface {
+	Reload(config map[string]string) error
+}
+
+// ReadinessChecker is implemented by sources with dependencies (eg. the storage api) that are needed to process events
+type ReadinessChecker interface {
+	Ready() error
+}
+
+// ErrRestartRequired is returned by Reload when the source has to be restarted to apply the new config
+var ErrRestartRequired = errors.New("config change requires a restart")
+
+const (
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopping   = "stopping"
+	StateStopped    = "stopped"
+)
+
+type Status struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+
+	// when the source last completed a loop iteration (processed an event, a poll, a batch of messages). Used to
+	// detect stuck sources.
+	LastActivity time.Time `json:"lastActivity"`
+	Restarts     int       `json:"restarts"`
+
+	// a running source is considered stuck if there has been no activity for this long (0 disables the check)
+	LivenessTimeout time.Duration `json:"-"`
+}
+
+// Stuck returns an error if the source is running, but has not made any progress within its liveness timeout
+func (s Status) Stuck(now time.Time) error {
+	if s.State == StateRunning && s.LivenessTimeout > 0 && now.Sub(s.LastActivity) > s.LivenessTimeout {
+		return fmt.Errorf("no activity since %v", s.LastActivity.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// statusTracker is embedded by sources to implement Status()
+type statusTracker struct {
+	statusMutex sync.RWMutex
+	status      Status
+}
+
+func (t *statusTracker) Status() Status {
+	t.statusMutex.RLock()
+	defer t.statusMutex.RUnlock()
+	return t.status
+}
+
+func (t *statusTracker) setState(state string, err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.State = state
+	t.status.Error = ""
+	if err != nil {
+		t.status.Error = err.Error()
+	}
+	t.status.LastActivity = time.Now()
+}
+
+func (t *statusTracker) setLivenessTimeout(timeout time.Duration) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LivenessTimeout = timeout
+}
+
+// touch records that the source is alive
+func (t *statusTracker) touch() {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status.LastActivity = time.Now()
+}
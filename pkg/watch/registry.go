@@ -0,0 +1,64 @@
+package watch
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]func() Interface{}
+)
+
+// Register makes a source available by name. It is usually called from the init function of the source's file, and
+// panics if the name is registered twice.
+func Register(name string, factory func() Interface) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("watch: source %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New creates a new instance of the named source
+func New(name string) (Interface, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	factory, exists := registry[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown source %q (available: %v)", name, sourceNames())
+	}
+	return factory(), nil
+}
+
+// Validate checks the config of a source without starting it
+func Validate(source SourceConfig) error {
+	instance, err := New(source.Source)
+	if err != nil {
+		return err
+	}
+	if err := instance.Validate(source.Config); err != nil {
+		return fmt.Errorf("source %v: %v", source.Name, err)
+	}
+	return nil
+}
+
+// Sources lists the names of the registered sources
+func Sources() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	return sourceNames()
+}
+
+func sourceNames() []string {
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,342 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/analogj/lodestone-publisher/pkg/notify"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// When restarting a source after a failure
+	minRestartDelay = 5 * time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+// SourceConfig describes a single instance of a registered source (eg. one watched directory, or one mailbox)
+type SourceConfig struct {
+	// name used in logs & status reporting, defaults to the source name
+	Name   string
+	Source string
+	Config map[string]string
+}
+
+// Supervisor runs multiple sources in a single process. Each source runs independently, so a failure in one (eg. an
+// unavailable mount, or an unreachable imap server) is retried with backoff without affecting the others.
+type Supervisor struct {
+	logger       *logrus.Entry
+	notifyClient notify.Interface
+	ctx          context.Context
+	wg           sync.WaitGroup
+
+	// serializes reloads, so that sources are not added & removed concurrently
+	reloadMutex sync.Mutex
+
+	mutex    sync.RWMutex
+	running  []*supervisedSource
+	stopping bool
+}
+
+type supervisedSource struct {
+	statusTracker
+	SourceConfig
+
+	cancel  context.CancelFunc
+	stopped chan bool
+
+	mutex    sync.RWMutex
+	instance Interface
+}
+
+// ReloadResult lists the sources (by name) affected by a reload
+type ReloadResult struct {
+	Added     []string
+	Removed   []string
+	Restarted []string
+	Reloaded  []string
+	Unchanged []string
+}
+
+func (r ReloadResult) String() string {
+	return fmt.Sprintf("added %v, removed %v, restarted %v, reloaded in place %v, unchanged %v",
+		r.Added, r.Removed, r.Restarted, r.Reloaded, r.Unchanged)
+}
+
+// Start runs every source, blocking until the context is cancelled and every source has shut down.
+// Returns an error without starting anything if one of the sources is not registered, or has an invalid config.
+func (s *Supervisor) Start(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface, sources []SourceConfig) error {
+	sources, err := prepareSources(sources)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.logger = logger
+	s.notifyClient = notifyClient
+	s.ctx = ctx
+	running := []*supervisedSource{}
+	for _, sourceConfig := range sources {
+		running = append(running, s.startSource(sourceConfig))
+	}
+	s.running = running
+	s.mutex.Unlock()
+
+	<-ctx.Done()
+	s.mutex.Lock()
+	s.stopping = true
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Reload applies a new list of sources (matched by name) to the running supervisor: new sources are started, missing
+// sources are stopped, and sources with a changed config are reloaded in place if they support it (see Reloader), or
+// restarted otherwise. Unchanged sources keep running undisturbed.
+// Nothing is changed if one of the new sources is invalid.
+func (s *Supervisor) Reload(sources []SourceConfig) (ReloadResult, error) {
+	result := ReloadResult{}
+	sources, err := prepareSources(sources)
+	if err != nil {
+		return result, err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	s.mutex.RLock()
+	previous := map[string]*supervisedSource{}
+	for _, source := range s.running {
+		previous[source.Name] = source
+	}
+	stopping := s.stopping || s.ctx == nil
+	s.mutex.RUnlock()
+	if stopping {
+		return result, errors.New("supervisor is not running")
+	}
+
+	running := []*supervisedSource{}
+	for _, sourceConfig := range sources {
+		source, exists := previous[sourceConfig.Name]
+		delete(previous, sourceConfig.Name)
+		if !exists {
+			s.logger.Infof("Starting new source: %v", sourceConfig.Name)
+			running = append(running, s.startSource(sourceConfig))
+			result.Added = append(result.Added, sourceConfig.Name)
+			continue
+		}
+
+		source.mutex.RLock()
+		currentConfig := source.SourceConfig
+		instance := source.instance
+		source.mutex.RUnlock()
+		if reflect.DeepEqual(currentConfig, sourceConfig) {
+			running = append(running, source)
+			result.Unchanged = append(result.Unchanged, sourceConfig.Name)
+			continue
+		}
+
+		if reloader, ok := instance.(Reloader); ok && currentConfig.Source == sourceConfig.Source {
+			err := reloader.Reload(sourceConfig.Config)
+			if err == nil {
+				source.mutex.Lock()
+				source.Config = sourceConfig.Config
+				source.mutex.Unlock()
+				running = append(running, source)
+				result.Reloaded = append(result.Reloaded, sourceConfig.Name)
+				continue
+			}
+			s.logger.Infof("Unable to reload source %v in place (%v), restarting it", sourceConfig.Name, err)
+		}
+		source.stop()
+		running = append(running, s.startSource(sourceConfig))
+		result.Restarted = append(result.Restarted, sourceConfig.Name)
+	}
+	for _, source := range s.running {
+		if _, removed := previous[source.Name]; removed {
+			s.logger.Infof("Stopping removed source: %v", source.Name)
+			source.stop()
+			result.Removed = append(result.Removed, source.Name)
+		}
+	}
+
+	s.mutex.Lock()
+	s.running = running
+	s.mutex.Unlock()
+	return result, nil
+}
+
+// Status reports the state of every supervised source
+func (s *Supervisor) Status() []Status {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	statuses := []Status{}
+	for _, source := range s.running {
+		statuses = append(statuses, source.currentStatus())
+	}
+	return statuses
+}
+
+// Liveness checks that no source is stuck, returning the error (or nil) for each source by name
+func (s *Supervisor) Liveness() map[string]error {
+	now := time.Now()
+	results := map[string]error{}
+	for _, status := range s.Status() {
+		results[status.Name] = status.Stuck(now)
+	}
+	return results
+}
+
+// Readiness checks that every source is running, is not stuck, and that its dependencies are available. Returns the
+// error (or nil) for each source by name.
+func (s *Supervisor) Readiness() map[string]error {
+	s.mutex.RLock()
+	running := append([]*supervisedSource{}, s.running...)
+	s.mutex.RUnlock()
+
+	now := time.Now()
+	results := map[string]error{}
+	for _, source := range running {
+		status := source.currentStatus()
+		if status.State != StateRunning {
+			if status.Error != "" {
+				results[status.Name] = fmt.Errorf("source is %v: %v", status.State, status.Error)
+			} else {
+				results[status.Name] = fmt.Errorf("source is %v", status.State)
+			}
+			continue
+		}
+		if err := status.Stuck(now); err != nil {
+			results[status.Name] = err
+			continue
+		}
+
+		source.mutex.RLock()
+		instance := source.instance
+		source.mutex.RUnlock()
+		if checker, ok := instance.(ReadinessChecker); ok {
+			results[status.Name] = checker.Ready()
+		} else {
+			results[status.Name] = nil
+		}
+	}
+	return results
+}
+
+// startSource runs the source in the background, until the supervisor's context is cancelled or the source is stopped.
+// The caller must hold s.mutex, or s.reloadMutex.
+func (s *Supervisor) startSource(sourceConfig SourceConfig) *supervisedSource {
+	ctx, cancel := context.WithCancel(s.ctx)
+	source := &supervisedSource{SourceConfig: sourceConfig, cancel: cancel, stopped: make(chan bool)}
+	source.setState(StateStarting, nil)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(source.stopped)
+		source.supervise(ctx, s.logger.WithField("source", source.Name), s.notifyClient)
+	}()
+	return source
+}
+
+// prepareSources validates the sources, filling in default names. Names must be unique, as they are used to match
+// sources when reloading.
+func prepareSources(sources []SourceConfig) ([]SourceConfig, error) {
+	prepared := []SourceConfig{}
+	names := map[string]bool{}
+	for _, sourceConfig := range sources {
+		if sourceConfig.Name == "" {
+			sourceConfig.Name = sourceConfig.Source
+		}
+		if names[sourceConfig.Name] {
+			return nil, fmt.Errorf("source %v: name is used more than once", sourceConfig.Name)
+		}
+		names[sourceConfig.Name] = true
+		if err := Validate(sourceConfig); err != nil {
+			return nil, err
+		}
+		prepared = append(prepared, sourceConfig)
+	}
+	return prepared, nil
+}
+
+// stop cancels the source, and waits for it to shut down
+func (ss *supervisedSource) stop() {
+	ss.cancel()
+	<-ss.stopped
+}
+
+func (ss *supervisedSource) supervise(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface) {
+	restartDelay := minRestartDelay
+	for {
+		started := time.Now()
+		err := ss.run(ctx, logger, notifyClient)
+		if ctx.Err() != nil {
+			logger.Infoln("Source stopped")
+			ss.setState(StateStopped, err)
+			return
+		}
+
+		logger.Errorf("Source stopped: %v. Restarting in %v", err, restartDelay)
+		ss.setState(StateRestarting, err)
+		ss.statusMutex.Lock()
+		ss.status.Restarts++
+		ss.statusMutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			ss.setState(StateStopped, err)
+			return
+		case <-time.After(restartDelay):
+		}
+
+		// reset the backoff if the source was healthy for a while, otherwise back off exponentially
+		if time.Since(started) > maxRestartDelay {
+			restartDelay = minRestartDelay
+		} else if restartDelay *= 2; restartDelay > maxRestartDelay {
+			restartDelay = maxRestartDelay
+		}
+	}
+}
+
+// run starts a new instance of the source, converting panics into errors so that they can be retried
+func (ss *supervisedSource) run(ctx context.Context, logger *logrus.Entry, notifyClient notify.Interface) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	instance, err := New(ss.Source)
+	if err != nil {
+		return err
+	}
+	ss.mutex.Lock()
+	ss.instance = instance
+	config := ss.Config
+	ss.mutex.Unlock()
+
+	return instance.Start(ctx, logger, notifyClient, config)
+}
+
+// currentStatus combines the supervisor's view (restarts, failures) with the running instance's own status
+func (ss *supervisedSource) currentStatus() Status {
+	status := ss.Status()
+	status.Name = ss.Name
+
+	ss.mutex.RLock()
+	instance := ss.instance
+	ss.mutex.RUnlock()
+
+	if instance != nil && status.State != StateRestarting && status.State != StateStopped {
+		instanceStatus := instance.Status()
+		instanceStatus.Name = ss.Name
+		instanceStatus.Restarts = status.Restarts
+		return instanceStatus
+	}
+	return status
+}